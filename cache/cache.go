@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"backlink/metrics"
+)
+
+// Cache is a size bounded map whose entries expire after ttl, the least
+// recently used entry is evicted when it is full. Name labels its hits and
+// misses in metrics.CacheLookups.
+type Cache struct {
+	name string
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func New(name string, size int, ttl time.Duration) *Cache {
+	return &Cache{
+		name:    name,
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Get returns the value stored under key unless it has expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if ok && time.Now().After(element.Value.(*entry).expires) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		metrics.CacheLookups.WithLabelValues(c.name, "miss").Inc()
+		return nil, false
+	}
+
+	metrics.CacheLookups.WithLabelValues(c.name, "hit").Inc()
+	c.order.MoveToFront(element)
+	return element.Value.(*entry).value, true
+}
+
+func (c *Cache) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		element.Value = &entry{key: key, value: value, expires: expires}
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *Cache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry).key)
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"backlink/logger"
+	"backlink/redact"
+	"backlink/schedule"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Secret is a string that is never printed, so a Config can be logged as is.
+type Secret string
+
+func (secret Secret) String() string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func (secret Secret) GoString() string {
+	return secret.String()
+}
+
+type Slack struct {
+	AppToken      Secret `yaml:"app_token"`
+	BotToken      Secret `yaml:"bot_token"`
+	SigningSecret Secret `yaml:"signing_secret"`
+
+	ClientID     string `yaml:"client_id"`
+	ClientSecret Secret `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+}
+
+type Notion struct {
+	Token     Secret   `yaml:"token"`
+	RootPages []string `yaml:"root_pages"`
+
+	ClientID     string `yaml:"client_id"`
+	ClientSecret Secret `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+}
+
+type DB struct {
+	DSN   Secret `yaml:"dsn"`
+	Debug bool   `yaml:"debug"`
+}
+
+type Channels struct {
+	// Allow and Deny hold channel ids. When Allow is set only those
+	// channels are captured, Deny always wins.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type Format struct {
+	// TimeLayout and Timezone control the time in each entry's header.
+	TimeLayout string `yaml:"time_layout"`
+	Timezone   string `yaml:"timezone"`
+	// LinkText labels the link back to the slack message.
+	LinkText string `yaml:"link_text"`
+}
+
+type Reactions struct {
+	// Prompt is the emoji, without colons, that asks which backlink to add
+	// a message to.
+	Prompt string `yaml:"prompt"`
+	// Backlinks maps an emoji to the backlink it adds messages to.
+	Backlinks map[string]string `yaml:"backlinks"`
+}
+
+type Redaction struct {
+	Disabled bool `yaml:"disabled"`
+	// Detectors names the builtin detectors to run, empty runs all of them.
+	Detectors []string `yaml:"detectors"`
+	// Custom maps a name to a regular expression, matches are replaced
+	// with "[redacted <name>]".
+	Custom map[string]string `yaml:"custom"`
+}
+
+type Digest struct {
+	// At is the time of day, in format.timezone, digests are posted.
+	At string `yaml:"at"`
+	// Weekday is the day weekly digests are posted.
+	Weekday string `yaml:"weekday"`
+	// Top is how many pages each list in a digest shows.
+	Top int `yaml:"top"`
+	// OrphanDays is how long a page goes without mentions before the
+	// digest calls it orphaned.
+	OrphanDays int `yaml:"orphan_days"`
+}
+
+type Log struct {
+	// Level is the lowest level logged: debug, info, warn or error.
+	Level string `yaml:"level"`
+}
+
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP collector spans are sent to, e.g.
+	// "localhost:4318". Tracing is off without one.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over plain http, as local collectors expect.
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is the share of traces kept, from 0 to 1.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type Config struct {
+	Slack     Slack     `yaml:"slack"`
+	Notion    Notion    `yaml:"notion"`
+	DB        DB        `yaml:"db"`
+	Channels  Channels  `yaml:"channels"`
+	Format    Format    `yaml:"format"`
+	Redaction Redaction `yaml:"redaction"`
+	Reactions Reactions `yaml:"reactions"`
+	Digest    Digest    `yaml:"digest"`
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+
+	// Confirmations is how captures are confirmed: "ephemeral", "thread"
+	// or "off".
+	Confirmations string `yaml:"confirmations"`
+
+	HTTPAddr   string `yaml:"http_addr"`
+	GitSinkDir string `yaml:"git_sink_dir"`
+}
+
+func Default() Config {
+	return Config{
+		Format: Format{
+			TimeLayout: time.RFC822,
+			Timezone:   "UTC",
+			LinkText:   "Go To Message",
+		},
+		Reactions: Reactions{
+			Prompt: "link",
+		},
+		Digest: Digest{
+			At:         "09:00",
+			Weekday:    "monday",
+			Top:        5,
+			OrphanDays: 30,
+		},
+		Log: Log{
+			Level: "info",
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+		Confirmations: "ephemeral",
+		HTTPAddr:      ":8080",
+	}
+}
+
+// Load reads the yaml file at path on top of the defaults and applies the
+// environment overrides. A missing file is not an error so the bot can still be
+// configured from the environment alone. Call Validate before running the bot.
+func Load(path string) (Config, error) {
+	config := Default()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return Config{}, err
+		}
+		if err == nil {
+			if err := yaml.UnmarshalStrict(data, &config); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	config.applyEnv()
+
+	return config, nil
+}
+
+// applyEnv overrides the file with any of the environment variables the bot
+// has always been configured with.
+func (config *Config) applyEnv() {
+	secret := func(name string, value *Secret) {
+		if v := os.Getenv(name); v != "" {
+			*value = Secret(v)
+		}
+	}
+	str := func(name string, value *string) {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+
+	secret("SLACK_APP_TOKEN", &config.Slack.AppToken)
+	secret("SLACK_BOT_TOKEN", &config.Slack.BotToken)
+	secret("SLACK_SIGNING_SECRET", &config.Slack.SigningSecret)
+	str("SLACK_CLIENT_ID", &config.Slack.ClientID)
+	secret("SLACK_CLIENT_SECRET", &config.Slack.ClientSecret)
+	str("SLACK_REDIRECT_URL", &config.Slack.RedirectURL)
+
+	secret("NOTION_SECRET", &config.Notion.Token)
+	str("NOTION_CLIENT_ID", &config.Notion.ClientID)
+	secret("NOTION_CLIENT_SECRET", &config.Notion.ClientSecret)
+	str("NOTION_REDIRECT_URL", &config.Notion.RedirectURL)
+	if v := os.Getenv("B_PARENT"); v != "" {
+		config.Notion.RootPages = strings.Split(v, ",")
+	}
+
+	secret("DB_DSN", &config.DB.DSN)
+	if user := os.Getenv("DB_USER"); user != "" && config.DB.DSN == "" {
+		config.DB.DSN = Secret(legacyDSN(user))
+	}
+
+	str("LOG_LEVEL", &config.Log.Level)
+	str("OTEL_EXPORTER_OTLP_ENDPOINT", &config.Tracing.Endpoint)
+	str("HTTP_ADDR", &config.HTTPAddr)
+	str("GIT_SINK_DIR", &config.GitSinkDir)
+}
+
+// legacyDSN is the cockroach cluster the bot was first deployed to, kept for
+// setups that only set DB_USER.
+func legacyDSN(user string) string {
+	return "postgresql://" + user +
+		"@free-tier.gcp-us-central1.cockroachlabs.cloud:26257/defaultdb" +
+		"?sslmode=verify-full" +
+		"&sslrootcert=/home/aadi/root.crt" +
+		"&options=--cluster%3Dclear-weasel-3066"
+}
+
+// Validate returns every problem with the config at once.
+func (config Config) Validate() error {
+	var problems []string
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	slack := config.Slack
+	check(slack.AppToken != "" || slack.SigningSecret != "",
+		"slack.app_token (socket mode) or slack.signing_secret (http mode) is required")
+	check(slack.AppToken == "" || strings.HasPrefix(string(slack.AppToken), "xapp-"),
+		"slack.app_token should be an app level token starting with xapp-")
+	check(slack.BotToken == "" || strings.HasPrefix(string(slack.BotToken), "xoxb-"),
+		"slack.bot_token should be a bot token starting with xoxb-")
+	check(slack.ClientID == "" || (slack.ClientSecret != "" && slack.RedirectURL != ""),
+		"slack.client_secret and slack.redirect_url are required with slack.client_id")
+	check(slack.BotToken != "" || slack.ClientID != "",
+		"slack.bot_token or slack.client_id (OAuth install) is required")
+
+	notion := config.Notion
+	check(notion.ClientID == "" || (notion.ClientSecret != "" && notion.RedirectURL != ""),
+		"notion.client_secret and notion.redirect_url are required with notion.client_id")
+	check(config.GitSinkDir != "" || notion.Token != "" || notion.ClientID != "",
+		"notion.token, notion.client_id or git_sink_dir is required")
+	check(notion.Token == "" || len(notion.RootPages) > 0,
+		"notion.root_pages is required with notion.token")
+
+	check(config.DB.DSN != "", "db.dsn is required")
+
+	check(config.Format.TimeLayout != "", "format.time_layout can't be empty")
+	switch config.Confirmations {
+	case "ephemeral", "thread", "off":
+	default:
+		problems = append(problems, "confirmations should be ephemeral, thread or off")
+	}
+	if _, err := redact.New(config.Redaction.Detectors, config.Redaction.Custom); err != nil {
+		problems = append(problems, "redaction: "+err.Error())
+	}
+	if _, err := time.LoadLocation(config.Format.Timezone); err != nil {
+		problems = append(problems, "format.timezone: "+err.Error())
+	}
+	if _, _, err := schedule.ParseClock(config.Digest.At); err != nil {
+		problems = append(problems, "digest.at: "+err.Error())
+	}
+	if _, err := schedule.ParseWeekday(config.Digest.Weekday); err != nil {
+		problems = append(problems, "digest.weekday: "+err.Error())
+	}
+	if _, err := logger.ParseLevel(config.Log.Level); err != nil {
+		problems = append(problems, "log.level: "+err.Error())
+	}
+	check(config.Digest.Top > 0, "digest.top should be at least 1")
+	check(config.Digest.OrphanDays > 0, "digest.orphan_days should be at least 1")
+	check(config.Tracing.SampleRatio >= 0 && config.Tracing.SampleRatio <= 1,
+		"tracing.sample_ratio should be between 0 and 1")
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Location is the parsed format.timezone.
+func (config Config) Location() *time.Location {
+	location, err := time.LoadLocation(config.Format.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
@@ -3,98 +3,1155 @@ package db
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/cockroachdb/cockroach-go/crdb/crdbgorm"
-	"github.com/jinzhu/gorm"
+	"backlink/cache"
+	"backlink/logger"
+	"backlink/metrics"
+	"backlink/tracing"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbgorm"
+	"github.com/jackc/pgconn"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 var db *gorm.DB
 
-func InitDB(debug bool, user string) (err error) {
-	var addr = "postgresql://" + user +
-		"@free-tier.gcp-us-central1.cockroachlabs.cloud:26257/defaultdb" +
-		"?sslmode=verify-full" +
-		"&sslrootcert=/home/aadi/root.crt" +
-		"&options=--cluster%3Dclear-weasel-3066"
+// InitDB connects to dsn and migrates the schema. A dsn starting with
+// sqlite:// opens the SQLite database at the path that follows, anything
+// else is a postgres (or cockroach) connection string.
+func InitDB(debug bool, dsn string) (err error) {
+	db, err = gorm.Open(dialector(dsn), &gorm.Config{
+		// debug logs every statement with its values, tokens included
+		Logger: gormLogger{debug: debug},
+	})
+	if err != nil {
+		return err
+	}
 
-	db, err = gorm.Open("postgres", addr)
+	if err := instrument(db); err != nil {
+		return err
+	}
+
+	// existing rows have to fit the unique indexes before AutoMigrate
+	// creates them
+	ctx := context.Background()
+	if err := migrateBacklinkNames(ctx); err != nil {
+		return err
+	}
+	if err := prepareWorkspaceInstalls(ctx); err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&Workspace{}, &Backlink{}, &ChannelRule{}, &Entry{}, &OptOut{}, &Backfill{}, &Digest{}, &Occurrence{})
+	if err != nil {
+		return err
+	}
 
-	db.LogMode(debug)
-	DropAllTables()
-	db.AutoMigrate(&Workspace{}, &Backlink{})
+	return migrateWorkspaceKeys(ctx)
+}
 
-	return
+func dialector(dsn string) gorm.Dialector {
+	if path := strings.TrimPrefix(dsn, "sqlite://"); path != dsn {
+		return sqlite.Open(path)
+	}
+	return postgres.Open(dsn)
 }
 
 func DeinitDB() error {
-	return db.Close()
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// gormLogger sends gorm's own logs to the logger of the context a query was
+// made for. Statements are only logged with debug.
+type gormLogger struct {
+	debug bool
+}
+
+func (gl gormLogger) LogMode(gormlogger.LogLevel) gormlogger.Interface {
+	return gl
+}
+
+func (gormLogger) Info(ctx context.Context, msg string, values ...interface{}) {
+	logger.FromContext(ctx).Debug("gorm", "values", fmt.Sprintf(msg, values...))
+}
+
+func (gormLogger) Warn(ctx context.Context, msg string, values ...interface{}) {
+	logger.FromContext(ctx).Warn("gorm", "values", fmt.Sprintf(msg, values...))
+}
+
+func (gormLogger) Error(ctx context.Context, msg string, values ...interface{}) {
+	logger.FromContext(ctx).Error("gorm", "values", fmt.Sprintf(msg, values...))
+}
+
+func (gl gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if !gl.debug {
+		return
+	}
+	sql, rows := fc()
+	logger.FromContext(ctx).Debug("gorm", "sql", sql, "rows", rows, "duration", time.Since(begin), "err", err)
+}
+
+// Ping is a readiness check for the db connection.
+func Ping() error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Ping()
+}
+
+// conn returns the db handle for queries made on behalf of ctx, which is
+// how the event's logger reaches the query callbacks. Inside Transaction the
+// handle is the transaction's.
+func conn(ctx context.Context) *gorm.DB {
+	handle := db
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		handle = tx
+	}
+	return handle.WithContext(ctx)
 }
 
+type txKey struct{}
+
+// Transaction runs fn in a transaction, retrying it when cockroach asks to.
+// Every query made with the ctx fn is given is part of the transaction, and
+// a Transaction inside fn joins it rather than starting another. Only
+// cockroach runs it serializable, postgres reads committed rows, so a fn
+// that reads a row and creates it when missing should go through
+// readOrCreate.
+func Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return fn(ctx)
+	}
+	return crdbgorm.ExecuteTx(ctx, conn(ctx), nil,
+		func(tx *gorm.DB) error {
+			return fn(context.WithValue(ctx, txKey{}, tx))
+		},
+	)
+}
+
+// readOrCreate runs fn, which reads a row and creates it when missing, in a
+// transaction. Below serializable two callers can both miss the row; the
+// loser's insert fails on the table's unique index and fn runs again to read
+// the row the winner created.
+func readOrCreate(ctx context.Context, fn func(ctx context.Context) error) error {
+	err := Transaction(ctx, fn)
+	if isUniqueViolation(err) {
+		logger.FromContext(ctx).Debug("concurrent insert, reading it", "err", err)
+		err = Transaction(ctx, fn)
+	}
+	return err
+}
+
+// isUniqueViolation reports whether err is an insert that conflicted with a
+// unique index.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// unique_violation
+		return pgErr.Code == "23505"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+// instrument times every query into metrics.DBDuration, traces it as a child
+// of the context it was made for and logs it with that context's logger.
+func instrument(db *gorm.DB) error {
+	system := db.Dialector.Name()
+	if system == "postgres" {
+		system = "postgresql"
+	}
+	start := func(operation string) func(tx *gorm.DB) {
+		return func(tx *gorm.DB) {
+			_, span := tracing.Start(tx.Statement.Context, "db "+operation+" "+tx.Statement.Table,
+				attribute.String("db.system", system),
+				attribute.String("db.operation", operation),
+				attribute.String("db.sql.table", tx.Statement.Table))
+			tx.InstanceSet("metrics:start", time.Now())
+			tx.InstanceSet("tracing:span", span)
+		}
+	}
+	observe := func(operation string) func(tx *gorm.DB) {
+		return func(tx *gorm.DB) {
+			started, ok := tx.InstanceGet("metrics:start")
+			if !ok {
+				return
+			}
+			elapsed := time.Since(started.(time.Time))
+			metrics.DBDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+
+			err := tx.Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				err = nil
+			}
+			if span, ok := tx.InstanceGet("tracing:span"); ok {
+				tracing.End(span.(trace.Span), err)
+			}
+
+			logger.FromContext(tx.Statement.Context).Debug("db query", "operation", operation, "table", tx.Statement.Table,
+				"rows", tx.RowsAffected, "duration", elapsed)
+		}
+	}
+
+	callback := db.Callback()
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("metrics:start", start("create")),
+		callback.Create().After("gorm:create").Register("metrics:observe", observe("create")),
+		callback.Update().Before("gorm:update").Register("metrics:start", start("update")),
+		callback.Update().After("gorm:update").Register("metrics:observe", observe("update")),
+		callback.Delete().Before("gorm:delete").Register("metrics:start", start("delete")),
+		callback.Delete().After("gorm:delete").Register("metrics:observe", observe("delete")),
+		callback.Query().Before("gorm:query").Register("metrics:start", start("query")),
+		callback.Query().After("gorm:query").Register("metrics:observe", observe("query")),
+		callback.Row().Before("gorm:row").Register("metrics:start", start("row_query")),
+		callback.Row().After("gorm:row").Register("metrics:observe", observe("row_query")),
+		callback.Raw().Before("gorm:raw").Register("metrics:start", start("raw")),
+		callback.Raw().After("gorm:raw").Register("metrics:observe", observe("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Workspace is one installed slack team, keyed by TeamID. SlackTeam is only
+// the display name, kept up to date by team_rename events.
 type Workspace struct {
 	gorm.Model
 
 	SlackTeam string
 	Backlinks []Backlink `gorm:"foreignKey:WorkspaceID"`
+
+	// Set once the app has been installed. EnterpriseID is the Enterprise
+	// Grid org the team belongs to, if any. An install for a whole org has
+	// only the EnterpriseID. Rows from before installs, with neither, are
+	// left out of the index.
+	TeamID       string `gorm:"uniqueIndex:idx_workspaces_install,priority:2,where:team_id <> '' OR enterprise_id <> ''"`
+	EnterpriseID string `gorm:"uniqueIndex:idx_workspaces_install,priority:1"`
+	BotToken     string
+	BotUserID    string
+
+	// NotionToken and RootPages (comma separated page ids) say where the
+	// team's backlinks are written.
+	NotionToken string
+	RootPages   string
+
+	// Filled in when notion was connected through the public integration.
+	NotionBotID         string
+	NotionWorkspaceID   string
+	NotionWorkspaceName string
+
+	// Which channels are captured, see ChannelRule.
+	IgnorePrivate bool
+	IgnoreDMs     bool
+	RequireOptIn  bool
 }
 
+// Backlink is the page a [[name]] is captured to. A workspace has one per
+// root page and normalized name.
 type Backlink struct {
 	gorm.Model
 
 	LinkName string
-	NotionID string
+	// NormalizedName is what lookups match on, set from LinkName on save.
+	NormalizedName string `gorm:"uniqueIndex:idx_backlinks_workspace_root_name,priority:3"`
+	NotionID       string
+	// RootPage is the root the page was routed to, empty for the default.
+	RootPage string `gorm:"uniqueIndex:idx_backlinks_workspace_root_name,priority:2"`
+
+	WorkspaceID uint `gorm:"uniqueIndex:idx_backlinks_workspace_root_name,priority:1"`
+}
+
+// BeforeSave is called by gorm.
+func (backlink *Backlink) BeforeSave(tx *gorm.DB) error {
+	backlink.NormalizedName = NormalizeName(backlink.LinkName)
+	return nil
+}
+
+// NormalizeName is how backlink names are compared, so [[Atlas]] and
+// [[ atlas ]] go to the same page.
+func NormalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+	RuleRoute = "route"
+)
+
+// ChannelRule decides whether a channel is captured and where its new
+// backlink pages go. A rule matches a single channel by ChannelID (what
+// /backlink enable creates) or channel names by the glob Pattern.
+type ChannelRule struct {
+	gorm.Model
 
 	WorkspaceID uint
+
+	ChannelID string
+	Pattern   string
+
+	Action   string
+	RootPage string
 }
 
-func GetWorkspaceInfo(teamName string) (info Workspace) {
-	db.Where(&Workspace{SlackTeam: teamName}, "slackteam").Take(&info)
+var ErrBacklinkNotFound = errors.New("cannot find backlink")
 
-	backlinks := []Backlink{}
-	db.Where(&Backlink{WorkspaceID: info.ID}, "workspaceid").Find(&backlinks)
-	info.Backlinks = backlinks
+// backlinkCache is a read-through cache of backlinks by workspace, root page and
+// normalized name. Backlinks that don't exist aren't cached so pages created
+// by another instance are still found.
+var backlinkCache = cache.New("backlink", 10000, time.Hour)
+
+func backlinkKey(workspaceID uint, rootPage string, normalizedName string) string {
+	return fmt.Sprintf("%d/%s/%s", workspaceID, rootPage, normalizedName)
+}
 
-	return
+// GetBacklink returns the backlink for name under rootPage.
+func GetBacklink(ctx context.Context, workspaceID uint, rootPage string, name string) (Backlink, error) {
+	found, err := GetBacklinksByName(ctx, workspaceID, rootPage, []string{name})
+	if err != nil {
+		return Backlink{}, err
+	}
+	backlink, ok := found[NormalizeName(name)]
+	if !ok {
+		return Backlink{}, ErrBacklinkNotFound
+	}
+	return backlink, nil
 }
 
-func GetNotionID(teamName string, backlinkName string) (string, error) {
-	workspace := GetWorkspaceInfo(teamName)
-	for _, backlink := range workspace.Backlinks {
-		if backlink.LinkName == backlinkName {
-			return backlink.NotionID, nil
+// GetBacklinksByName looks up every name under rootPage in one query, keyed
+// by normalized name. Names without a backlink are left out.
+func GetBacklinksByName(ctx context.Context, workspaceID uint, rootPage string, names []string) (map[string]Backlink, error) {
+	found := map[string]Backlink{}
+	var missing []string
+	for _, name := range names {
+		normalized := NormalizeName(name)
+		if backlink, ok := backlinkCache.Get(backlinkKey(workspaceID, rootPage, normalized)); ok {
+			found[normalized] = backlink.(Backlink)
+			continue
+		}
+		missing = append(missing, normalized)
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	rows := []Backlink{}
+	err := conn(ctx).Where("workspace_id = ? AND root_page = ? AND normalized_name IN (?)", workspaceID, rootPage, missing).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, backlink := range rows {
+		// claimed backlinks get their page soon, see ClaimBacklink
+		if backlink.NotionID != "" {
+			backlinkCache.Set(backlinkKey(workspaceID, rootPage, backlink.NormalizedName), backlink)
 		}
+		found[backlink.NormalizedName] = backlink
 	}
-	return "", errors.New("cannot find backlink")
+	return found, nil
 }
 
-func AddWorkspace(teamName string) error {
-	return crdbgorm.ExecuteTx(context.Background(), db, nil,
-		func(tx *gorm.DB) error {
-			return db.Create(&Workspace{SlackTeam: teamName, Backlinks: []Backlink{}}).Error
+// AddWorkspace creates the workspace for teamID unless it already exists.
+func AddWorkspace(ctx context.Context, teamID string) error {
+	return readOrCreate(ctx,
+		func(ctx context.Context) error {
+			return conn(ctx).Where("team_id = ?", teamID).FirstOrCreate(&Workspace{TeamID: teamID}).Error
 		},
 	)
 }
 
-func AddBacklinkToWorkspace(teamName string, backlink Backlink) error {
-	return crdbgorm.ExecuteTx(context.Background(), db, nil,
-		func(tx *gorm.DB) error {
-			workspace := GetWorkspaceInfo(teamName)
-			workspace.Backlinks = append(workspace.Backlinks, backlink)
-			return db.Save(&workspace).Error
+// claimTimeout is how long a claimed backlink waits for its page before
+// another capture may take over creating it, e.g. after a crash.
+const claimTimeout = time.Minute
+
+// claimPoll is how often ClaimBacklink checks on a page someone else is
+// creating.
+const claimPoll = 500 * time.Millisecond
+
+// ClaimBacklink makes sure only one capture creates the page for name under
+// rootPage. It returns the backlink and whether the caller claimed it, in
+// which case the caller creates the page and calls SetBacklinkPage, or
+// ReleaseBacklink if that fails. While someone else holds the claim it waits
+// for their page, so the backlink comes back with a NotionID unless the
+// caller claimed it, at most claimTimeout later.
+func ClaimBacklink(ctx context.Context, workspaceID uint, rootPage string, name string) (Backlink, bool, error) {
+	for {
+		backlink, claimed, err := claimBacklink(ctx, workspaceID, rootPage, name)
+		if err != nil || claimed || backlink.NotionID != "" {
+			return backlink, claimed, err
+		}
+
+		select {
+		case <-time.After(claimPoll):
+		case <-ctx.Done():
+			return Backlink{}, false, ctx.Err()
+		}
+	}
+}
+
+func claimBacklink(ctx context.Context, workspaceID uint, rootPage string, name string) (backlink Backlink, claimed bool, err error) {
+	err = readOrCreate(ctx,
+		func(ctx context.Context) error {
+			tx := conn(ctx)
+			backlink, claimed = Backlink{}, false
+
+			err := tx.Where("workspace_id = ? AND root_page = ? AND normalized_name = ?",
+				workspaceID, rootPage, NormalizeName(name)).Take(&backlink).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				backlink = Backlink{WorkspaceID: workspaceID, RootPage: rootPage, LinkName: name}
+				claimed = true
+				return tx.Create(&backlink).Error
+			}
+			if err != nil {
+				return err
+			}
+
+			if backlink.NotionID == "" && time.Since(backlink.UpdatedAt) > claimTimeout {
+				claimed = true
+				// bumps updated_at so nobody else takes over
+				return tx.Model(&backlink).Update("link_name", name).Error
+			}
+			return nil
+		},
+	)
+	return backlink, claimed, err
+}
+
+// SetBacklinkPage stores the page created for a claimed backlink.
+func SetBacklinkPage(ctx context.Context, backlink Backlink, notionID string) error {
+	err := conn(ctx).Model(&backlink).Update("notion_id", notionID).Error
+	if err != nil {
+		return err
+	}
+	backlink.NotionID = notionID
+	backlinkCache.Set(backlinkKey(backlink.WorkspaceID, backlink.RootPage, backlink.NormalizedName), backlink)
+	return nil
+}
+
+// ReleaseBacklink gives up a claim whose page could not be created.
+func ReleaseBacklink(ctx context.Context, id uint) error {
+	return conn(ctx).Unscoped().Where("id = ? AND notion_id = ''", id).Delete(&Backlink{}).Error
+}
+
+// Entry maps a captured slack message to the sink entry it was written to, so
+// it can be found again by author.
+type Entry struct {
+	gorm.Model
+
+	WorkspaceID uint
+	BacklinkID  uint
+
+	PageID  string
+	EntryID string
+
+	ChannelID string
+	MessageTS string
+	AuthorID  string
+
+	// Reaction is the emoji the message was captured with, if any, and
+	// ReactorID who reacted. Removing that reaction removes the entry.
+	Reaction  string
+	ReactorID string
+}
+
+// OptOut marks a user whose messages are never captured.
+type OptOut struct {
+	gorm.Model
+
+	WorkspaceID uint
+	UserID      string
+}
+
+// Backfill is the checkpoint of importing a channel's history between two
+// slack timestamps, either of which may be empty for an open range.
+type Backfill struct {
+	gorm.Model
+
+	WorkspaceID uint
+	ChannelID   string
+	Oldest      string
+	Latest      string
+
+	// LastTS is the newest message that has been written.
+	LastTS string
+	Done   bool
+}
+
+// GetInstallation returns the workspace installed for a slack team, or the
+// install of its Enterprise Grid org when the team has none of its own.
+func GetInstallation(ctx context.Context, enterpriseID, teamID string) (Workspace, error) {
+	var workspace Workspace
+	err := gorm.ErrRecordNotFound
+	if teamID != "" {
+		err = conn(ctx).Where("team_id = ?", teamID).Take(&workspace).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) && enterpriseID != "" {
+		err = conn(ctx).Where("enterprise_id = ? AND team_id = ''", enterpriseID).Take(&workspace).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Workspace{}, errors.New("team not installed")
+	}
+	return workspace, err
+}
+
+// SaveInstallation stores the bot credentials for a team, creating the
+// workspace if the team has not been seen before. Notion settings are only
+// filled in for new workspaces so reinstalling keeps what was configured.
+// Installs are keyed by EnterpriseID and TeamID, an install for a whole
+// Enterprise Grid org has no TeamID.
+func SaveInstallation(ctx context.Context, install Workspace) error {
+	enterpriseInstall := install.TeamID == "" && install.EnterpriseID != ""
+	if install.TeamID == "" && !enterpriseInstall {
+		return errors.New("install has no team id")
+	}
+
+	return readOrCreate(ctx,
+		func(ctx context.Context) error {
+			tx := conn(ctx)
+			var workspace Workspace
+			var err error
+			if enterpriseInstall {
+				err = tx.Where("enterprise_id = ? AND team_id = ''", install.EnterpriseID).Take(&workspace).Error
+			} else {
+				// team ids are unique across orgs, a team that moved into
+				// one keeps its row
+				err = tx.Where("team_id = ?", install.TeamID).Take(&workspace).Error
+				if errors.Is(err, gorm.ErrRecordNotFound) && install.SlackTeam != "" {
+					// adopt a row from before installs were keyed by team id
+					err = tx.Where("slack_team = ? AND team_id = '' AND enterprise_id = ''", install.SlackTeam).Take(&workspace).Error
+				}
+			}
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return tx.Create(&install).Error
+			}
+			if err != nil {
+				return err
+			}
+
+			workspace.SlackTeam = install.SlackTeam
+			workspace.TeamID = install.TeamID
+			workspace.EnterpriseID = install.EnterpriseID
+			workspace.BotToken = install.BotToken
+			workspace.BotUserID = install.BotUserID
+			if workspace.NotionToken == "" {
+				workspace.NotionToken = install.NotionToken
+			}
+			if workspace.RootPages == "" {
+				workspace.RootPages = install.RootPages
+			}
+			return tx.Save(&workspace).Error
+		},
+	)
+}
+
+// SaveNotionAuth stores the notion token a workspace authorized. Root pages
+// are cleared when the token belongs to a different notion workspace since
+// they would no longer be reachable.
+func SaveNotionAuth(ctx context.Context, id uint, token, botID, workspaceID, workspaceName string) error {
+	return Transaction(ctx,
+		func(ctx context.Context) error {
+			tx := conn(ctx)
+			var workspace Workspace
+			if err := tx.Where("id = ?", id).Take(&workspace).Error; err != nil {
+				return err
+			}
+
+			if workspace.NotionWorkspaceID != workspaceID {
+				workspace.RootPages = ""
+			}
+			workspace.NotionToken = token
+			workspace.NotionBotID = botID
+			workspace.NotionWorkspaceID = workspaceID
+			workspace.NotionWorkspaceName = workspaceName
+			return tx.Save(&workspace).Error
+		},
+	)
+}
+
+// RenameWorkspace updates the display name of a team.
+func RenameWorkspace(ctx context.Context, teamID string, name string) error {
+	return conn(ctx).Model(&Workspace{}).Where("team_id = ?", teamID).Update("slack_team", name).Error
+}
+
+func SetRootPages(ctx context.Context, workspaceID uint, rootPages string) error {
+	return conn(ctx).Model(&Workspace{}).Where("id = ?", workspaceID).Update("root_pages", rootPages).Error
+}
+
+func GetChannelRules(ctx context.Context, workspaceID uint) ([]ChannelRule, error) {
+	rules := []ChannelRule{}
+	err := conn(ctx).Where("workspace_id = ?", workspaceID).Order("id").Find(&rules).Error
+	return rules, err
+}
+
+func AddChannelRule(ctx context.Context, rule ChannelRule) error {
+	return conn(ctx).Create(&rule).Error
+}
+
+func DeleteChannelRule(ctx context.Context, workspaceID uint, id uint) error {
+	result := conn(ctx).Where("workspace_id = ? AND id = ?", workspaceID, id).Delete(&ChannelRule{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("no such rule")
+	}
+	return nil
+}
+
+// SetChannelRule replaces the rule for a single channel id.
+func SetChannelRule(ctx context.Context, workspaceID uint, channelID string, action string) error {
+	return Transaction(ctx,
+		func(ctx context.Context) error {
+			tx := conn(ctx)
+			err := tx.Where("workspace_id = ? AND channel_id = ?", workspaceID, channelID).Delete(&ChannelRule{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Create(&ChannelRule{WorkspaceID: workspaceID, ChannelID: channelID, Action: action}).Error
+		},
+	)
+}
+
+// SetWorkspaceSetting updates one of the channel capture flags on Workspace,
+// field is the column name e.g. "ignore_private".
+func SetWorkspaceSetting(ctx context.Context, workspaceID uint, field string, value bool) error {
+	switch field {
+	case "ignore_private", "ignore_dms", "require_opt_in":
+	default:
+		return errors.New("unknown setting " + field)
+	}
+	return conn(ctx).Model(&Workspace{}).Where("id = ?", workspaceID).Update(field, value).Error
+}
+
+func AddEntry(ctx context.Context, entry Entry) error {
+	return conn(ctx).Create(&entry).Error
+}
+
+func GetEntriesByAuthor(ctx context.Context, workspaceID uint, authorID string) ([]Entry, error) {
+	entries := []Entry{}
+	err := conn(ctx).Where("workspace_id = ? AND author_id = ?", workspaceID, authorID).Find(&entries).Error
+	return entries, err
+}
+
+// GetEntriesByReaction returns the entries a reaction created on a message.
+func GetEntriesByReaction(ctx context.Context, workspaceID uint, channelID, messageTS, reaction, reactorID string) ([]Entry, error) {
+	entries := []Entry{}
+	err := conn(ctx).Where("workspace_id = ? AND channel_id = ? AND message_ts = ? AND reaction = ? AND reactor_id = ?",
+		workspaceID, channelID, messageTS, reaction, reactorID).Find(&entries).Error
+	return entries, err
+}
+
+// EntryExists reports whether a message was already captured under a backlink.
+func EntryExists(ctx context.Context, workspaceID uint, backlinkID uint, channelID, messageTS string) (bool, error) {
+	var count int64
+	err := conn(ctx).Model(&Entry{}).Where("workspace_id = ? AND backlink_id = ? AND channel_id = ? AND message_ts = ?",
+		workspaceID, backlinkID, channelID, messageTS).Count(&count).Error
+	return count > 0, err
+}
+
+// DeleteEntry removes the mapping once the sink entry is gone. The row is
+// hard deleted so nothing about the message is kept.
+func DeleteEntry(ctx context.Context, id uint) error {
+	return conn(ctx).Unscoped().Delete(&Entry{}, id).Error
+}
+
+func IsOptedOut(ctx context.Context, workspaceID uint, userID string) (bool, error) {
+	var count int64
+	err := conn(ctx).Model(&OptOut{}).Where("workspace_id = ? AND user_id = ?", workspaceID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+func SetOptOut(ctx context.Context, workspaceID uint, userID string, optOut bool) error {
+	return Transaction(ctx,
+		func(ctx context.Context) error {
+			tx := conn(ctx)
+			err := tx.Unscoped().Where("workspace_id = ? AND user_id = ?", workspaceID, userID).Delete(&OptOut{}).Error
+			if err != nil || !optOut {
+				return err
+			}
+			return tx.Create(&OptOut{WorkspaceID: workspaceID, UserID: userID}).Error
+		},
+	)
+}
+
+// GetBackfill returns the checkpoint for a channel and range, starting a new
+// one if the range was never backfilled.
+func GetBackfill(ctx context.Context, workspaceID uint, channelID, oldest, latest string) (Backfill, error) {
+	var backfill Backfill
+	err := Transaction(ctx,
+		func(ctx context.Context) error {
+			backfill = Backfill{WorkspaceID: workspaceID, ChannelID: channelID, Oldest: oldest, Latest: latest}
+			return conn(ctx).Where("workspace_id = ? AND channel_id = ? AND oldest = ? AND latest = ?",
+				workspaceID, channelID, oldest, latest).FirstOrCreate(&backfill).Error
 		},
 	)
+	return backfill, err
 }
 
-func BacklinkExists(teamName string, backlinkName string) bool {
-	workspace := GetWorkspaceInfo(teamName)
-	for _, backlink := range workspace.Backlinks {
-		if backlink.LinkName == backlinkName {
-			return true
+func SaveBackfillProgress(ctx context.Context, id uint, lastTS string) error {
+	return conn(ctx).Model(&Backfill{}).Where("id = ?", id).Update("last_ts", lastTS).Error
+}
+
+func FinishBackfill(ctx context.Context, id uint) error {
+	return conn(ctx).Model(&Backfill{}).Where("id = ?", id).Update("done", true).Error
+}
+
+// Digest subscribes a channel to a periodic summary of backlink activity.
+type Digest struct {
+	gorm.Model
+
+	WorkspaceID uint
+	ChannelID   string
+	// Frequency is DigestDaily or DigestWeekly.
+	Frequency string
+}
+
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// GetWorkspace returns a workspace by row id.
+func GetWorkspace(ctx context.Context, id uint) (Workspace, error) {
+	var workspace Workspace
+	err := conn(ctx).Where("id = ?", id).Take(&workspace).Error
+	return workspace, err
+}
+
+// GetDigests returns every channel subscribed at frequency.
+func GetDigests(ctx context.Context, frequency string) ([]Digest, error) {
+	digests := []Digest{}
+	err := conn(ctx).Where("frequency = ?", frequency).Find(&digests).Error
+	return digests, err
+}
+
+// SetDigest subscribes a channel, replacing any earlier subscription. An
+// empty frequency unsubscribes it.
+func SetDigest(ctx context.Context, workspaceID uint, channelID string, frequency string) error {
+	return Transaction(ctx,
+		func(ctx context.Context) error {
+			tx := conn(ctx)
+			err := tx.Unscoped().Where("workspace_id = ? AND channel_id = ?", workspaceID, channelID).Delete(&Digest{}).Error
+			if err != nil || frequency == "" {
+				return err
+			}
+			return tx.Create(&Digest{WorkspaceID: workspaceID, ChannelID: channelID, Frequency: frequency}).Error
+		},
+	)
+}
+
+// CountMentions returns how many times each backlink was mentioned in
+// [from, to), keyed by backlink id.
+func CountMentions(ctx context.Context, workspaceID uint, from, to time.Time) (map[uint]int, error) {
+	rows, err := conn(ctx).Model(&Occurrence{}).
+		Select("backlink_id, count(*)").
+		Where("workspace_id = ? AND mentioned_at >= ? AND mentioned_at < ?", workspaceID, from, to).
+		Group("backlink_id").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[uint]int{}
+	for rows.Next() {
+		var id uint
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
 		}
+		counts[id] = count
 	}
-	return false
+	return counts, rows.Err()
+}
+
+// GetNewBacklinks returns the backlinks whose pages were created in [from, to).
+func GetNewBacklinks(ctx context.Context, workspaceID uint, from, to time.Time) ([]Backlink, error) {
+	backlinks := []Backlink{}
+	err := conn(ctx).Where("workspace_id = ? AND created_at >= ? AND created_at < ?", workspaceID, from, to).
+		Order("created_at").Find(&backlinks).Error
+	return backlinks, err
+}
+
+// GetOrphanedBacklinks returns the backlinks older than since that haven't
+// been mentioned since.
+func GetOrphanedBacklinks(ctx context.Context, workspaceID uint, since time.Time) ([]Backlink, error) {
+	backlinks := []Backlink{}
+	err := conn(ctx).Where("workspace_id = ? AND created_at < ?", workspaceID, since).
+		Where("id NOT IN (?)", conn(ctx).Model(&Occurrence{}).Select("backlink_id").
+			Where("workspace_id = ? AND mentioned_at >= ?", workspaceID, since)).
+		Order("link_name").Find(&backlinks).Error
+	return backlinks, err
+}
+
+// GetBacklinks returns the backlinks with the given row ids.
+func GetBacklinks(ctx context.Context, ids []uint) ([]Backlink, error) {
+	backlinks := []Backlink{}
+	if len(ids) == 0 {
+		return backlinks, nil
+	}
+	err := conn(ctx).Where("id IN (?)", ids).Find(&backlinks).Error
+	return backlinks, err
+}
+
+// Occurrence is one [[mention]] of a backlink in a slack message.
+type Occurrence struct {
+	gorm.Model
+
+	WorkspaceID uint
+	BacklinkID  uint
+
+	ChannelID string
+	UserID    string
+	TS        string
+	// ThreadTS is the thread the mention was a reply in, if any.
+	ThreadTS  string
+	Permalink string
+
+	// MentionedAt is when the message was posted, which for backfilled
+	// messages is long before the row was created.
+	MentionedAt time.Time
+}
+
+// AddOccurrence records a mention once, however many times the message is
+// seen.
+func AddOccurrence(ctx context.Context, occurrence Occurrence) error {
+	return Transaction(ctx,
+		func(ctx context.Context) error {
+			row := occurrence
+			return conn(ctx).Where("workspace_id = ? AND backlink_id = ? AND channel_id = ? AND ts = ?",
+				occurrence.WorkspaceID, occurrence.BacklinkID, occurrence.ChannelID, occurrence.TS).
+				FirstOrCreate(&row).Error
+		},
+	)
+}
+
+// DeleteOccurrencesByUser hard deletes every mention a user made.
+func DeleteOccurrencesByUser(ctx context.Context, workspaceID uint, userID string) error {
+	return conn(ctx).Unscoped().Where("workspace_id = ? AND user_id = ?", workspaceID, userID).Delete(&Occurrence{}).Error
+}
+
+// FindBacklinks returns the backlinks named name under any root page.
+func FindBacklinks(ctx context.Context, workspaceID uint, name string) ([]Backlink, error) {
+	backlinks := []Backlink{}
+	err := conn(ctx).Where("workspace_id = ? AND normalized_name = ?", workspaceID, NormalizeName(name)).Find(&backlinks).Error
+	return backlinks, err
+}
+
+// Tally is a count of mentions for a period, channel or user.
+type Tally struct {
+	Key   string
+	Count int
+}
+
+// MentionsOverTime counts a backlink's mentions in [from, to) per unit, which
+// is "day", "week" or "month". Keys are the start of each unit in UTC,
+// weeks starting on monday, formatted as 2006-01-02, and units without
+// mentions are left out.
+func MentionsOverTime(ctx context.Context, backlinkID uint, from, to time.Time, unit string) ([]Tally, error) {
+	switch unit {
+	case "day", "week", "month":
+	default:
+		return nil, errors.New("unknown unit " + unit)
+	}
+
+	// bucketed here rather than with date_trunc, which sqlite doesn't have
+	var times []time.Time
+	err := conn(ctx).Model(&Occurrence{}).
+		Where("backlink_id = ? AND mentioned_at >= ? AND mentioned_at < ?", backlinkID, from, to).
+		Pluck("mentioned_at", &times).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, t := range times {
+		counts[truncate(t, unit).Format("2006-01-02")]++
+	}
+
+	tallies := []Tally{}
+	for key, count := range counts {
+		tallies = append(tallies, Tally{Key: key, Count: count})
+	}
+	sort.Slice(tallies, func(i, j int) bool {
+		return tallies[i].Key < tallies[j].Key
+	})
+	return tallies, nil
+}
+
+// truncate returns the start of the day, week or month t is in, like
+// postgres' date_trunc in UTC.
+func truncate(t time.Time, unit string) time.Time {
+	t = t.UTC()
+	switch unit {
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// TopChannels returns the channels a backlink is mentioned in most in
+// [from, to), keyed by channel id.
+func TopChannels(ctx context.Context, backlinkID uint, from, to time.Time, limit int) ([]Tally, error) {
+	return topOccurrences(ctx, "channel_id", backlinkID, from, to, limit)
+}
+
+// TopContributors returns the users who mention a backlink most in
+// [from, to), keyed by user id.
+func TopContributors(ctx context.Context, backlinkID uint, from, to time.Time, limit int) ([]Tally, error) {
+	return topOccurrences(ctx, "user_id", backlinkID, from, to, limit)
+}
+
+func topOccurrences(ctx context.Context, column string, backlinkID uint, from, to time.Time, limit int) ([]Tally, error) {
+	tallies := []Tally{}
+	err := conn(ctx).Model(&Occurrence{}).
+		Select(column+` AS "key", count(*) AS "count"`).
+		Where("backlink_id = ? AND mentioned_at >= ? AND mentioned_at < ?", backlinkID, from, to).
+		Group(column).Order(`"count" DESC, "key"`).Limit(limit).
+		Scan(&tallies).Error
+	return tallies, err
+}
+
+// workspaceTables are the tables whose rows belong to a workspace through
+// their workspace_id column.
+var workspaceTables = []interface{}{&Backlink{}, &ChannelRule{}, &Entry{}, &OptOut{}, &Backfill{}, &Digest{}, &Occurrence{}}
+
+// migrateWorkspaceKeys folds workspaces from before installs were keyed by
+// team id, which only have a SlackTeam name, into the installed workspace of
+// the same name. Everything the old row owned moves over and the old row is
+// deleted. Rows whose team was never installed are left for SaveInstallation
+// to adopt.
+func migrateWorkspaceKeys(ctx context.Context) error {
+	var legacy []Workspace
+	err := conn(ctx).Where("team_id = '' AND enterprise_id = '' AND slack_team <> ''").Find(&legacy).Error
+	if err != nil {
+		return err
+	}
+
+	for _, old := range legacy {
+		var installed Workspace
+		err := conn(ctx).Where("team_id <> '' AND slack_team = ?", old.SlackTeam).Order("id").Take(&installed).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = Transaction(ctx,
+			func(ctx context.Context) error {
+				if err := moveWorkspaceRows(ctx, old.ID, installed.ID); err != nil {
+					return err
+				}
+				return conn(ctx).Delete(&old).Error
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("migrating workspace %q: %w", old.SlackTeam, err)
+		}
+		logger.FromContext(ctx).Info("migrated workspace to team id", "team", old.SlackTeam, "team_id", installed.TeamID)
+	}
+
+	return nil
+}
+
+// moveWorkspaceRows hands everything workspace from owns over to workspace
+// to. Backlinks both have are merged into to's, and tables that don't exist
+// yet are skipped.
+func moveWorkspaceRows(ctx context.Context, from, to uint) error {
+	tx := conn(ctx)
+	if tx.Migrator().HasTable(&Backlink{}) {
+		var backlinks []Backlink
+		if err := tx.Unscoped().Where("workspace_id = ?", from).Find(&backlinks).Error; err != nil {
+			return err
+		}
+		for _, backlink := range backlinks {
+			var kept Backlink
+			err := tx.Unscoped().Where("workspace_id = ? AND root_page = ? AND normalized_name = ?",
+				to, backlink.RootPage, backlink.NormalizedName).Order("id").Take(&kept).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := mergeBacklink(ctx, backlink, kept); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, table := range workspaceTables {
+		if !tx.Migrator().HasTable(table) {
+			continue
+		}
+		err := tx.Unscoped().Model(table).Where("workspace_id = ?", from).Update("workspace_id", to).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareWorkspaceInstalls makes existing workspaces fit
+// idx_workspaces_install before AutoMigrate creates it. Columns added after
+// rows existed hold NULL rather than an empty string, which the index would
+// treat as distinct, and a team saved twice by concurrent installs is merged
+// into its oldest row.
+func prepareWorkspaceInstalls(ctx context.Context) error {
+	migrator := conn(ctx).Migrator()
+	if !migrator.HasTable(&Workspace{}) || migrator.HasIndex(&Workspace{}, "idx_workspaces_install") {
+		return nil
+	}
+
+	for _, column := range []string{"team_id", "enterprise_id"} {
+		if !migrator.HasColumn(&Workspace{}, column) {
+			if err := migrator.AddColumn(&Workspace{}, column); err != nil {
+				return err
+			}
+		}
+		err := conn(ctx).Unscoped().Model(&Workspace{}).Where(column+" IS NULL").UpdateColumn(column, "").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var duplicates []Workspace
+	err := conn(ctx).Unscoped().Where("(team_id <> '' OR enterprise_id <> '') AND id NOT IN (?)",
+		conn(ctx).Unscoped().Model(&Workspace{}).Select("min(id)").Group("enterprise_id, team_id")).
+		Find(&duplicates).Error
+	if err != nil {
+		return err
+	}
+	for _, duplicate := range duplicates {
+		var kept Workspace
+		err := conn(ctx).Unscoped().Where("enterprise_id = ? AND team_id = ?", duplicate.EnterpriseID, duplicate.TeamID).
+			Order("id").Take(&kept).Error
+		if err != nil {
+			return err
+		}
+
+		err = Transaction(ctx,
+			func(ctx context.Context) error {
+				if err := moveWorkspaceRows(ctx, duplicate.ID, kept.ID); err != nil {
+					return err
+				}
+				return conn(ctx).Unscoped().Delete(&duplicate).Error
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("merging workspace %q: %w", duplicate.TeamID, err)
+		}
+		logger.FromContext(ctx).Info("merged duplicate workspace", "team_id", duplicate.TeamID, "workspace_id", duplicate.ID, "into", kept.ID)
+	}
+
+	return nil
+}
+
+// migrateBacklinkNames fills in NormalizedName for backlinks saved before it
+// existed and merges backlinks that now share a name, keeping the oldest page
+// and moving entries and occurrences over to it, so AutoMigrate can add the
+// unique index lookups use. Once the index exists there is nothing to do.
+func migrateBacklinkNames(ctx context.Context) error {
+	migrator := conn(ctx).Migrator()
+	if !migrator.HasTable(&Backlink{}) || migrator.HasIndex(&Backlink{}, "idx_backlinks_workspace_root_name") {
+		return nil
+	}
+
+	for _, column := range []string{"normalized_name", "root_page"} {
+		if !migrator.HasColumn(&Backlink{}, column) {
+			if err := migrator.AddColumn(&Backlink{}, column); err != nil {
+				return err
+			}
+		}
+	}
+	err := conn(ctx).Unscoped().Model(&Backlink{}).Where("root_page IS NULL").UpdateColumn("root_page", "").Error
+	if err != nil {
+		return err
+	}
+
+	var unnamed []Backlink
+	err = conn(ctx).Unscoped().Where("normalized_name IS NULL OR normalized_name = ''").Find(&unnamed).Error
+	if err != nil {
+		return err
+	}
+	for _, backlink := range unnamed {
+		err := conn(ctx).Unscoped().Model(&backlink).UpdateColumn("normalized_name", NormalizeName(backlink.LinkName)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var duplicates []Backlink
+	err = conn(ctx).Unscoped().Where("id NOT IN (?)", conn(ctx).Unscoped().Model(&Backlink{}).
+		Select("min(id)").Group("workspace_id, root_page, normalized_name")).
+		Find(&duplicates).Error
+	if err != nil {
+		return err
+	}
+	for _, duplicate := range duplicates {
+		var kept Backlink
+		err := conn(ctx).Unscoped().Where("workspace_id = ? AND root_page = ? AND normalized_name = ?",
+			duplicate.WorkspaceID, duplicate.RootPage, duplicate.NormalizedName).Order("id").Take(&kept).Error
+		if err != nil {
+			return err
+		}
+
+		err = Transaction(ctx,
+			func(ctx context.Context) error {
+				return mergeBacklink(ctx, duplicate, kept)
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("merging backlink %q: %w", duplicate.LinkName, err)
+		}
+	}
+
+	return nil
+}
+
+// mergeBacklink moves the entries and occurrences of duplicate over to kept
+// and deletes duplicate.
+func mergeBacklink(ctx context.Context, duplicate, kept Backlink) error {
+	tx := conn(ctx)
+	for _, table := range []interface{}{&Entry{}, &Occurrence{}} {
+		if !tx.Migrator().HasTable(table) {
+			continue
+		}
+		err := tx.Unscoped().Model(table).Where("backlink_id = ?", duplicate.ID).Update("backlink_id", kept.ID).Error
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Delete(&duplicate).Error; err != nil {
+		return err
+	}
+	logger.FromContext(ctx).Info("merged duplicate backlink", "backlink_id", duplicate.ID, "into", kept.ID)
+	return nil
 }
 
-func DropAllTables() {
-	db.DropTableIfExists(&Workspace{})
-	db.DropTableIfExists(&Backlink{})
+func DropAllTables() error {
+	return db.Migrator().DropTable(&Workspace{}, &Backlink{}, &ChannelRule{}, &Entry{}, &OptOut{}, &Backfill{}, &Digest{}, &Occurrence{})
 }
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withDB runs test against a fresh SQLite database, and against postgres or
+// cockroach too when BACKLINK_TEST_DSN is set. Every table is dropped first,
+// so don't point it at a database you care about.
+func withDB(t *testing.T, test func(t *testing.T, ctx context.Context)) {
+	t.Run("sqlite", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "backlink.db")
+		openDB(t, "sqlite://"+path+"?_busy_timeout=5000")
+		test(t, context.Background())
+	})
+
+	dsn := os.Getenv("BACKLINK_TEST_DSN")
+	if dsn == "" {
+		return
+	}
+	t.Run("postgres", func(t *testing.T) {
+		openDB(t, dsn)
+		if err := DropAllTables(); err != nil {
+			t.Fatal(err)
+		}
+		if err := DeinitDB(); err != nil {
+			t.Fatal(err)
+		}
+		openDB(t, dsn)
+		test(t, context.Background())
+	})
+}
+
+func openDB(t *testing.T, dsn string) {
+	t.Helper()
+	if err := InitDB(false, dsn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeinitDB() })
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimBacklink(t *testing.T) {
+	withDB(t, func(t *testing.T, ctx context.Context) {
+		must(t, AddWorkspace(ctx, "T1"))
+		workspace, err := GetInstallation(ctx, "", "T1")
+		must(t, err)
+
+		first, claimed, err := ClaimBacklink(ctx, workspace.ID, "", "Atlas")
+		must(t, err)
+		if !claimed {
+			t.Fatal("first claim was not claimed")
+		}
+
+		// a second capture waits for the page of the first
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			SetBacklinkPage(ctx, first, "page-1")
+		}()
+		second, claimed, err := ClaimBacklink(ctx, workspace.ID, "", " atlas ")
+		must(t, err)
+		if claimed || second.ID != first.ID || second.NotionID != "page-1" {
+			t.Fatalf("second claim = %+v, %v, want page-1 of backlink %d", second, claimed, first.ID)
+		}
+
+		// a released claim can be claimed again
+		other, claimed, err := ClaimBacklink(ctx, workspace.ID, "", "Zeus")
+		must(t, err)
+		must(t, ReleaseBacklink(ctx, other.ID))
+		if _, claimed, err = ClaimBacklink(ctx, workspace.ID, "", "Zeus"); err != nil || !claimed {
+			t.Fatalf("claim after release = %v, %v", claimed, err)
+		}
+
+		// and so can one that was abandoned
+		abandoned, _, err := ClaimBacklink(ctx, workspace.ID, "routed", "Zeus")
+		must(t, err)
+		must(t, conn(ctx).Model(&abandoned).UpdateColumn("updated_at", time.Now().Add(-2*claimTimeout)).Error)
+		if _, claimed, err = ClaimBacklink(ctx, workspace.ID, "routed", "Zeus"); err != nil || !claimed {
+			t.Fatalf("claim after timeout = %v, %v", claimed, err)
+		}
+	})
+}
+
+func TestSaveInstallation(t *testing.T) {
+	withDB(t, func(t *testing.T, ctx context.Context) {
+		must(t, SaveInstallation(ctx, Workspace{SlackTeam: "Acme", TeamID: "T1", BotToken: "one", NotionToken: "notion"}))
+
+		// reinstalling updates the bot but keeps the notion settings
+		must(t, SaveInstallation(ctx, Workspace{SlackTeam: "Acme Inc", TeamID: "T1", BotToken: "two", NotionToken: "default"}))
+		workspace, err := GetInstallation(ctx, "", "T1")
+		must(t, err)
+		if workspace.SlackTeam != "Acme Inc" || workspace.BotToken != "two" || workspace.NotionToken != "notion" {
+			t.Fatalf("reinstall = %+v", workspace)
+		}
+
+		// a row from before team ids is adopted by name
+		legacy := Workspace{SlackTeam: "Globex"}
+		must(t, conn(ctx).Create(&legacy).Error)
+		must(t, SaveInstallation(ctx, Workspace{SlackTeam: "Globex", TeamID: "T2", BotToken: "three"}))
+		workspace, err = GetInstallation(ctx, "", "T2")
+		must(t, err)
+		if workspace.ID != legacy.ID {
+			t.Fatalf("install created workspace %d instead of adopting %d", workspace.ID, legacy.ID)
+		}
+
+		// an org install is keyed by the org and adopts nothing
+		stray := Workspace{SlackTeam: ""}
+		must(t, conn(ctx).Create(&stray).Error)
+		must(t, SaveInstallation(ctx, Workspace{EnterpriseID: "E1", BotToken: "four"}))
+		must(t, SaveInstallation(ctx, Workspace{EnterpriseID: "E1", BotToken: "five"}))
+		var org []Workspace
+		must(t, conn(ctx).Where("enterprise_id = ?", "E1").Find(&org).Error)
+		if len(org) != 1 || org[0].ID == stray.ID || org[0].BotToken != "five" {
+			t.Fatalf("org installs = %+v", org)
+		}
+
+		// teams of the org without an install of their own use the org's
+		for _, teamID := range []string{"", "T9"} {
+			workspace, err = GetInstallation(ctx, "E1", teamID)
+			must(t, err)
+			if workspace.ID != org[0].ID {
+				t.Fatalf("install of E1/%q = %+v, want the org install", teamID, workspace)
+			}
+		}
+		// but a team's own install comes first
+		must(t, SaveInstallation(ctx, Workspace{EnterpriseID: "E1", TeamID: "T3", BotToken: "six"}))
+		workspace, err = GetInstallation(ctx, "E1", "T3")
+		must(t, err)
+		if workspace.BotToken != "six" {
+			t.Fatalf("install of E1/T3 = %+v, want its own", workspace)
+		}
+		if _, err := GetInstallation(ctx, "E2", "T9"); err == nil {
+			t.Fatal("team of another org found an install")
+		}
+
+		if err := SaveInstallation(ctx, Workspace{SlackTeam: "Nobody"}); err == nil {
+			t.Fatal("install without team or enterprise id was saved")
+		}
+	})
+}
+
+func TestMigrateWorkspaceKeys(t *testing.T) {
+	withDB(t, func(t *testing.T, ctx context.Context) {
+		must(t, SaveInstallation(ctx, Workspace{SlackTeam: "Acme", TeamID: "T1"}))
+		installed, err := GetInstallation(ctx, "", "T1")
+		must(t, err)
+
+		legacy := Workspace{SlackTeam: "Acme"}
+		must(t, conn(ctx).Create(&legacy).Error)
+
+		kept := Backlink{WorkspaceID: installed.ID, LinkName: "Atlas", NotionID: "page-1"}
+		must(t, conn(ctx).Create(&kept).Error)
+		merged := Backlink{WorkspaceID: legacy.ID, LinkName: "atlas", NotionID: "page-2"}
+		must(t, conn(ctx).Create(&merged).Error)
+		moved := Backlink{WorkspaceID: legacy.ID, LinkName: "Zeus", NotionID: "page-3"}
+		must(t, conn(ctx).Create(&moved).Error)
+		must(t, AddEntry(ctx, Entry{WorkspaceID: legacy.ID, BacklinkID: merged.ID, MessageTS: "1.1"}))
+
+		must(t, migrateWorkspaceKeys(ctx))
+
+		var remaining int64
+		must(t, conn(ctx).Model(&Workspace{}).Where("id = ?", legacy.ID).Count(&remaining).Error)
+		if remaining != 0 {
+			t.Fatal("legacy workspace was kept")
+		}
+
+		var backlinks []Backlink
+		must(t, conn(ctx).Where("workspace_id = ?", installed.ID).Order("id").Find(&backlinks).Error)
+		if len(backlinks) != 2 || backlinks[0].ID != kept.ID || backlinks[1].ID != moved.ID {
+			t.Fatalf("backlinks after migration = %+v", backlinks)
+		}
+
+		var entries []Entry
+		must(t, conn(ctx).Find(&entries).Error)
+		if len(entries) != 1 || entries[0].WorkspaceID != installed.ID || entries[0].BacklinkID != kept.ID {
+			t.Fatalf("entries after migration = %+v", entries)
+		}
+	})
+}
+
+func TestMigrateBacklinkNames(t *testing.T) {
+	withDB(t, func(t *testing.T, ctx context.Context) {
+		migrator := conn(ctx).Migrator()
+		must(t, migrator.DropIndex(&Backlink{}, "idx_backlinks_workspace_root_name"))
+
+		oldest := Backlink{WorkspaceID: 1, LinkName: "Atlas", NotionID: "page-1"}
+		must(t, conn(ctx).Create(&oldest).Error)
+		duplicate := Backlink{WorkspaceID: 1, LinkName: "  ATLAS ", NotionID: "page-2"}
+		must(t, conn(ctx).Create(&duplicate).Error)
+		routed := Backlink{WorkspaceID: 1, LinkName: "atlas", RootPage: "design", NotionID: "page-3"}
+		must(t, conn(ctx).Create(&routed).Error)
+		// saved before names were normalized
+		must(t, conn(ctx).Model(&duplicate).UpdateColumn("normalized_name", "").Error)
+		must(t, AddOccurrence(ctx, Occurrence{WorkspaceID: 1, BacklinkID: duplicate.ID, TS: "1.1"}))
+
+		must(t, migrateBacklinkNames(ctx))
+		must(t, conn(ctx).AutoMigrate(&Backlink{}))
+		if !migrator.HasIndex(&Backlink{}, "idx_backlinks_workspace_root_name") {
+			t.Fatal("unique index was not created")
+		}
+
+		var backlinks []Backlink
+		must(t, conn(ctx).Unscoped().Order("id").Find(&backlinks).Error)
+		if len(backlinks) != 2 || backlinks[0].ID != oldest.ID || backlinks[1].ID != routed.ID {
+			t.Fatalf("backlinks after migration = %+v", backlinks)
+		}
+
+		var occurrences []Occurrence
+		must(t, conn(ctx).Find(&occurrences).Error)
+		if len(occurrences) != 1 || occurrences[0].BacklinkID != oldest.ID {
+			t.Fatalf("occurrences after migration = %+v", occurrences)
+		}
+
+		// the index now keeps names unique
+		if err := conn(ctx).Create(&Backlink{WorkspaceID: 1, LinkName: "atlas"}).Error; !isUniqueViolation(err) {
+			t.Fatalf("duplicate backlink = %v, want a unique violation", err)
+		}
+	})
+}
+
+func TestMentionsOverTime(t *testing.T) {
+	withDB(t, func(t *testing.T, ctx context.Context) {
+		// a monday, wednesday, the next monday and the month after
+		for i, day := range []string{"2021-07-05", "2021-07-07", "2021-07-12", "2021-08-02"} {
+			mentioned, err := time.Parse("2006-01-02", day)
+			must(t, err)
+			must(t, AddOccurrence(ctx, Occurrence{BacklinkID: 1, TS: day, MentionedAt: mentioned.Add(time.Duration(i) * time.Hour)}))
+		}
+
+		from := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+		for unit, want := range map[string][]Tally{
+			"week":  {{"2021-07-05", 2}, {"2021-07-12", 1}, {"2021-08-02", 1}},
+			"month": {{"2021-07-01", 3}, {"2021-08-01", 1}},
+		} {
+			tallies, err := MentionsOverTime(ctx, 1, from, to, unit)
+			must(t, err)
+			if len(tallies) != len(want) {
+				t.Fatalf("%s = %+v, want %+v", unit, tallies, want)
+			}
+			for i := range want {
+				if tallies[i] != want[i] {
+					t.Fatalf("%s = %+v, want %+v", unit, tallies, want)
+				}
+			}
+		}
+	})
+}
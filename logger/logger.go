@@ -0,0 +1,182 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "unknown"
+	}
+	return levelNames[level]
+}
+
+// ParseLevel parses one of debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.New("unknown log level " + name)
+}
+
+// Logger writes one json object per line with the time, level, message and
+// any fields added with With or passed as key value pairs.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+type output struct {
+	lock  sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// Default logs info and above to stdout until SetDefault replaces it.
+var Default = New(os.Stdout, LevelInfo)
+
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level}}
+}
+
+func SetDefault(logger *Logger) {
+	Default = logger
+}
+
+// With returns a logger that adds the key value pairs to every line.
+func (logger *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyValues))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{out: logger.out, fields: fields}
+}
+
+func (logger *Logger) Debug(msg string, keyValues ...interface{}) {
+	logger.log(LevelDebug, msg, keyValues)
+}
+
+func (logger *Logger) Info(msg string, keyValues ...interface{}) {
+	logger.log(LevelInfo, msg, keyValues)
+}
+
+func (logger *Logger) Warn(msg string, keyValues ...interface{}) {
+	logger.log(LevelWarn, msg, keyValues)
+}
+
+func (logger *Logger) Error(msg string, keyValues ...interface{}) {
+	logger.log(LevelError, msg, keyValues)
+}
+
+// Enabled reports whether lines at level are written, to skip building
+// expensive fields.
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= logger.out.level
+}
+
+// Output lets a Logger stand in for a *log.Logger, e.g. for the slack
+// client's logs, which are written at debug.
+func (logger *Logger) Output(calldepth int, s string) error {
+	logger.log(LevelDebug, strings.TrimSpace(s), nil)
+	return nil
+}
+
+func (logger *Logger) log(level Level, msg string, keyValues []interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(`{"time":`)
+	writeValue(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeValue(&line, level.String())
+	line.WriteString(`,"msg":`)
+	writeValue(&line, msg)
+	writeFields(&line, logger.fields)
+	writeFields(&line, keyValues)
+	line.WriteString("}\n")
+
+	logger.out.lock.Lock()
+	defer logger.out.lock.Unlock()
+	io.WriteString(logger.out.w, line.String())
+}
+
+func writeFields(line *strings.Builder, keyValues []interface{}) {
+	for i := 0; i < len(keyValues); i += 2 {
+		key := fmt.Sprint(keyValues[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keyValues) {
+			value = keyValues[i+1]
+		}
+
+		line.WriteString(",")
+		writeValue(line, key)
+		line.WriteString(":")
+		writeValue(line, value)
+	}
+}
+
+func writeValue(line *strings.Builder, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying logger, so everything handling one
+// event logs with the same fields.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger in ctx, or Default.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return logger
+		}
+	}
+	return Default
+}
+
+// NewID returns a random id to correlate the log lines of one event.
+func NewID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -1,74 +1,210 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"backlink/config"
 	"backlink/db"
+	"backlink/logger"
+	"backlink/markdown"
+	"backlink/metrics"
 	"backlink/notion"
+	"backlink/redact"
+	"backlink/schedule"
+	"backlink/sink"
 	"backlink/slack"
+	"backlink/tracing"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	// test stuff from db branch
+	configPath := flag.String("config", "backlink.yaml", "path to the yaml config file")
+	flag.Parse()
 
-	// 	//DropAllTables()
+	// .env is optional now that there is a config file
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		fatal("loading .env failed", err)
+	}
 
-	// 	//if err := AddWorkspace("nag"); err != nil {
-	// 	//	fmt.Println(err)
-	// 	//	panic(err)
-	// 	//}
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		fatal("loading config failed", err)
+	}
 
-	// 	//err := AddBacklinkToWorkspace("nag", Backlink{LinkName: "bushan", NotionID: "nagabushan"})
-	// 	//if err != nil {
-	// 	//	fmt.Println(err)
-	// 	//	panic(err)
-	// 	//}
+	level, err := logger.ParseLevel(conf.Log.Level)
+	if err != nil {
+		fatal("invalid config", err)
+	}
+	logger.SetDefault(logger.New(os.Stdout, level))
+	log := logger.Default
 
-	// 	workspace := GetWorkspaceInfo("nag")
-	// 	fmt.Println(workspace)
+	sink.TimeLayout = conf.Format.TimeLayout
+	sink.Location = conf.Location()
+	sink.LinkText = conf.Format.LinkText
 
-	// 	defer func() {
-	// 		if err := DeinitDB(); err != nil {
-	// 			fmt.Println(err)
-	// 		}
-	// 	}()
+	if flag.NArg() > 1 && flag.Arg(0) == "export" {
+		if conf.Notion.Token == "" || len(conf.Notion.RootPages) == 0 {
+			fatal("invalid config", errors.New("export needs notion.token and notion.root_pages"))
+		}
+		client := notion.NewClient(string(conf.Notion.Token))
+		// ExportPage fetches each backlink page itself
+		session, err := notion.NewSession(client, conf.Notion.RootPages, notion.LazyPages())
+		if err != nil {
+			log.Error("loading notion pages failed", "err", err)
+			return
+		}
+		if err := markdown.ExportVault(&session, flag.Arg(1)); err != nil {
+			log.Error("export failed", "err", err)
+		}
+		return
+	}
+
+	if err := conf.Validate(); err != nil {
+		fatal("invalid config", err)
+	}
+	// %+v so secrets go through Secret.String
+	log.Info("config loaded", "config", fmt.Sprintf("%+v", conf))
 
-	fmt.Println("hello")
-	err := godotenv.Load()
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Tracing.Endpoint, conf.Tracing.Insecure, conf.Tracing.SampleRatio)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("setting up tracing failed", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	slackAppToken := os.Getenv("SLACK_APP_TOKEN")
-	slackBotToken := os.Getenv("SLACK_BOT_TOKEN")
-	notionToken := os.Getenv("NOTION_SECRET")
-	userP := os.Getenv("DB_USER")
+	if err := db.InitDB(conf.DB.Debug, string(conf.DB.DSN)); err != nil {
+		log.Error("connecting to the db failed", "err", err)
+		return
+	}
+	defer db.DeinitDB()
 
-	log.Println("app", slackAppToken)
-	log.Println("bot", slackBotToken)
-	log.Println("notion", notionToken)
+	rootPages := strings.Join(conf.Notion.RootPages, ",")
+	teams := slack.NewTeams(func(workspace db.Workspace) (sink.Sink, error) {
+		return newSink(conf, workspace)
+	})
 
-	if err := db.InitDB(false, userP); err != nil {
-		log.Println(err)
-		return
+	// a bot token in the config is a single workspace deployment
+	if conf.Slack.BotToken != "" {
+		if err := teams.InstallToken(context.Background(), string(conf.Slack.BotToken), string(conf.Notion.Token), rootPages); err != nil {
+			log.Error("installing the bot token failed", "err", err)
+			return
+		}
 	}
-	//db.DropAllTables()
-	if err := db.AddWorkspace("ht6"); err != nil {
-		fmt.Println(err)
-		return
+
+	bot := &slack.Bot{
+		Teams:         teams,
+		Channels:      conf.Channels,
+		Reactions:     conf.Reactions,
+		Digest:        conf.Digest,
+		Confirmations: conf.Confirmations,
 	}
-	defer db.DeinitDB()
-	client := notion.NewClient(notionToken)
-	session, err := notion.NewSession(client, []string{os.Getenv("B_PARENT")})
-	if err != nil {
-		log.Println(err)
+	if !conf.Redaction.Disabled {
+		bot.Redactor, err = redact.New(conf.Redaction.Detectors, conf.Redaction.Custom)
+		if err != nil {
+			fatal("invalid config", err)
+		}
+	}
+
+	hour, minute, _ := schedule.ParseClock(conf.Digest.At)
+	weekday, _ := schedule.ParseWeekday(conf.Digest.Weekday)
+	schedule.Run(
+		schedule.Job{
+			Name: "daily digest",
+			Next: schedule.Daily(hour, minute, conf.Location()),
+			Run:  func(at time.Time) { bot.PostDigests(db.DigestDaily, at) },
+		},
+		schedule.Job{
+			Name: "weekly digest",
+			Next: schedule.Weekly(weekday, hour, minute, conf.Location()),
+			Run:  func(at time.Time) { bot.PostDigests(db.DigestWeekly, at) },
+		},
+	)
+
+	mux := http.NewServeMux()
+
+	health := &metrics.Health{}
+	health.Check("db", db.Ping)
+	if conf.Slack.AppToken != "" {
+		health.Check("socket_mode", slack.SocketModeStatus)
+	}
+	if conf.Notion.Token != "" {
+		client := notion.NewClient(string(conf.Notion.Token))
+		health.Check("notion", metrics.Cached(time.Minute, func() error {
+			_, err := client.SearchPages("", notion.Limit(1)).All()
+			return err
+		}))
+	}
+	health.Register(mux)
+
+	if conf.Slack.ClientID != "" {
+		oauth := slack.NewOAuth(conf.Slack.ClientID, string(conf.Slack.ClientSecret), conf.Slack.RedirectURL, teams)
+		oauth.NotionToken = string(conf.Notion.Token)
+		oauth.RootPages = rootPages
+		oauth.Register(mux)
+	}
+
+	if conf.Notion.ClientID != "" {
+		bot.Notion = slack.NewNotionOAuth(conf.Notion.ClientID, string(conf.Notion.ClientSecret), conf.Notion.RedirectURL, teams)
+		bot.Notion.Register(mux)
+	}
+
+	// http events mode, can run next to or instead of socket mode
+	if conf.Slack.SigningSecret != "" {
+		events := &slack.Events{SigningSecret: string(conf.Slack.SigningSecret), Bot: bot}
+		events.Register(mux)
+	}
+
+	if conf.Slack.AppToken == "" {
+		log.Info("http listening", "addr", conf.HTTPAddr)
+		log.Error("http server stopped", "err", http.ListenAndServe(conf.HTTPAddr, mux))
 		return
 	}
 
-	slack.Run(slackAppToken, slackBotToken, &session)
-	log.Println("notion")
+	go func() {
+		log.Info("http listening", "addr", conf.HTTPAddr)
+		log.Error("http server stopped", "err", http.ListenAndServe(conf.HTTPAddr, mux))
+	}()
+
+	slack.Run(string(conf.Slack.AppToken), bot)
+}
+
+func fatal(msg string, err error) {
+	logger.Default.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// newSink builds the sink a workspace writes its backlinks to.
+func newSink(conf config.Config, workspace db.Workspace) (sink.Sink, error) {
+	if conf.GitSinkDir != "" {
+		// an org install has no team, all of its teams share one repository
+		dir := workspace.TeamID
+		if dir == "" {
+			dir = workspace.EnterpriseID
+		}
+		return sink.NewGit(filepath.Join(conf.GitSinkDir, dir))
+	}
+
+	var pages []string
+	for _, page := range strings.Split(workspace.RootPages, ",") {
+		if page != "" {
+			pages = append(pages, page)
+		}
+	}
+
+	client := notion.NewClient(workspace.NotionToken)
+	// the sink only ever creates pages under the roots, their content isn't
+	// needed
+	session, err := notion.NewSession(client, pages, notion.LazyPages())
+	if err != nil {
+		return nil, err
+	}
+	return sink.NewNotion(&session), nil
 }
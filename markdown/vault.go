@@ -0,0 +1,235 @@
+package markdown
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"backlink/notion"
+)
+
+// ExportVault writes every backlink page below the session's root pages to dir
+// as an Obsidian-style vault, one markdown file per backlink. Titles that
+// come out as the same file name get the page's short id appended.
+func ExportVault(session *notion.Session, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// lowercased, file systems and obsidian tend to ignore case
+	used := map[string]bool{}
+	for _, root := range session.Pages {
+		for _, page := range root.Children {
+			name := FileName(page.Title)
+			if used[strings.ToLower(name)] {
+				name += " " + shortID(page.Id)
+			}
+			used[strings.ToLower(name)] = true
+
+			if err := ExportPage(session.Client, page, filepath.Join(dir, name+".md")); err != nil {
+				return fmt.Errorf("export %q: %w", page.Title, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExportPage fetches the blocks of a single backlink page and writes them to
+// path.
+func ExportPage(client notion.Client, page notion.InterfacePage, path string) error {
+	blocks, err := client.GetChildren(page.Id).All()
+	if err != nil {
+		return err
+	}
+
+	entries, body := Render(blocks)
+
+	var builder strings.Builder
+	builder.WriteString(FrontMatter(page.Title,
+		"notion_id", page.Id,
+		"notion_url", NotionURL(page.Id),
+		"entries", strconv.Itoa(entries),
+	))
+	builder.WriteString(body)
+
+	return ioutil.WriteFile(path, []byte(builder.String()), 0644)
+}
+
+// FrontMatter returns the YAML header placed at the top of each vault file.
+// fields are written in order as key, value pairs after the title.
+func FrontMatter(title string, fields ...string) string {
+	var builder strings.Builder
+
+	builder.WriteString("---\n")
+	builder.WriteString("title: " + strconv.Quote(title) + "\n")
+	builder.WriteString("aliases: [" + strconv.Quote(title) + "]\n")
+	for i := 0; i+1 < len(fields); i += 2 {
+		builder.WriteString(fields[i] + ": " + fields[i+1] + "\n")
+	}
+	builder.WriteString("tags: [backlink]\n")
+	builder.WriteString("---\n\n")
+
+	return builder.String()
+}
+
+// Render converts the blocks of a backlink page into markdown. Captured
+// messages (a heading_3 followed by paragraphs) become blockquotes; anything
+// else that was added to the page by hand is rendered as regular markdown.
+func Render(blocks []notion.Block) (int, string) {
+	var builder strings.Builder
+	entries := 0
+	quoting := false
+
+	for _, block := range blocks {
+		text := RichText(block.GetText())
+
+		switch {
+		case block.Type == "heading_3":
+			if quoting {
+				builder.WriteString("\n")
+			}
+			builder.WriteString("> **" + text + "**\n")
+			quoting = true
+			entries++
+		case quoting && block.Type == "paragraph":
+			builder.WriteString(Quote(text))
+		default:
+			if quoting {
+				builder.WriteString("\n")
+				quoting = false
+			}
+			builder.WriteString(Block(block.Type, text))
+		}
+	}
+
+	return entries, builder.String()
+}
+
+// Entry renders a captured message the same way Render does for pages
+// exported from notion.
+func Entry(header, text, linkText, permalink string) string {
+	if permalink == "" {
+		return Quote("**"+header+"**") + Quote(text)
+	}
+	return Quote("**"+header+"**") + Quote(text) + Quote("["+linkText+"]("+permalink+")")
+}
+
+// Block renders a single non-message block.
+func Block(kind, text string) string {
+	switch kind {
+	case "heading_1":
+		return "# " + text + "\n\n"
+	case "heading_2":
+		return "## " + text + "\n\n"
+	case "heading_3":
+		return "### " + text + "\n\n"
+	case "bulleted_list_item":
+		return "- " + text + "\n"
+	case "numbered_list_item":
+		return "1. " + text + "\n"
+	case "to_do":
+		return "- [ ] " + text + "\n"
+	case "child_page":
+		return ""
+	}
+
+	if text == "" {
+		return ""
+	}
+	return text + "\n\n"
+}
+
+// Quote prefixes every line of text with "> ".
+func Quote(text string) string {
+	if text == "" {
+		return ">\n"
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// RichText renders notion rich text as markdown. Text is written verbatim so
+// [[wikilinks]] copied from slack keep working inside the vault.
+func RichText(texts []notion.RichText) string {
+	var builder strings.Builder
+
+	for _, text := range texts {
+		content := ""
+		if text.PlainText != nil {
+			content = *text.PlainText
+		} else if text.Text != nil {
+			content = text.Text.Content
+		}
+
+		link := ""
+		if text.HREF != nil {
+			link = *text.HREF
+		} else if text.Text != nil && text.Text.Link != nil {
+			link = text.Text.Link.URL
+		}
+
+		if a := text.Annotations; a != nil && strings.TrimSpace(content) != "" {
+			if a.Code {
+				content = "`" + content + "`"
+			}
+			if a.Bold {
+				content = "**" + content + "**"
+			}
+			if a.Italic {
+				content = "*" + content + "*"
+			}
+			if a.Strikethrough {
+				content = "~~" + content + "~~"
+			}
+		}
+
+		if link != "" {
+			content = "[" + content + "](" + link + ")"
+		}
+
+		builder.WriteString(content)
+	}
+
+	return builder.String()
+}
+
+// FileName strips characters that obsidian does not allow in note names.
+func FileName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		switch r {
+		case '*', '"', '\\', '/', '<', '>', ':', '|', '?', '#', '^', '[', ']':
+			return '-'
+		}
+		return r
+	}, title)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "untitled"
+	}
+	return name
+}
+
+// shortID is the first 8 characters of a notion id, enough to tell apart
+// pages with the same title.
+func shortID(id string) string {
+	id = strings.ReplaceAll(id, "-", "")
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// NotionURL returns the browser url of a notion page.
+func NotionURL(id string) string {
+	return "https://www.notion.so/" + strings.ReplaceAll(id, "-", "")
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health answers liveness and readiness probes. The process is live as long
+// as it answers, it is ready when every check passes.
+type Health struct {
+	lock   sync.Mutex
+	checks []check
+}
+
+type check struct {
+	name string
+	run  func() error
+}
+
+// Check adds a readiness check.
+func (health *Health) Check(name string, run func() error) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	health.checks = append(health.checks, check{name: name, run: run})
+}
+
+// Register serves /metrics, /healthz and /readyz.
+func (health *Health) Register(mux *http.ServeMux) {
+	mux.Handle("/metrics", Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", health.ready)
+}
+
+// ready runs every check and lists how each went, answering 503 if any
+// failed.
+func (health *Health) ready(w http.ResponseWriter, r *http.Request) {
+	health.lock.Lock()
+	checks := append([]check{}, health.checks...)
+	health.lock.Unlock()
+
+	var lines []string
+	status := http.StatusOK
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			lines = append(lines, check.name+": "+err.Error())
+			status = http.StatusServiceUnavailable
+		} else {
+			lines = append(lines, check.name+": ok")
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// Cached runs check at most once every interval, e.g. for checks that call
+// a rate limited API.
+func Cached(interval time.Duration, check func() error) func() error {
+	var lock sync.Mutex
+	var last time.Time
+	var err error
+
+	return func() error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if time.Since(last) >= interval {
+			err = check()
+			last = time.Now()
+		}
+		return err
+	}
+}
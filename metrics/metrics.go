@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	SlackEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backlink_slack_events_total",
+		Help: "Slack events received, by event type.",
+	}, []string{"type"})
+
+	BacklinksExtracted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backlink_backlinks_extracted_total",
+		Help: "[[backlinks]] found in slack messages.",
+	})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backlink_event_queue_depth",
+		Help: "Slack events, commands and interactions acknowledged but not handled yet.",
+	})
+
+	NotionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backlink_notion_requests_total",
+		Help: "Requests made to the notion API, by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+
+	NotionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "backlink_notion_request_duration_seconds",
+		Help:    "Time taken by notion API requests, including retries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	Retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backlink_retries_total",
+		Help: "Requests retried after being rate limited, by service.",
+	}, []string{"service"})
+
+	RateLimitWait = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backlink_rate_limit_wait_seconds_total",
+		Help: "Time spent waiting on rate limits, by service.",
+	}, []string{"service"})
+
+	DBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "backlink_db_query_duration_seconds",
+		Help:    "Time taken by db queries, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backlink_cache_lookups_total",
+		Help: "Lookups of in-process caches, by cache and hit or miss.",
+	}, []string{"cache", "result"})
+)
+
+// Handler serves the metrics in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+var notionID = regexp.MustCompile(`[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}`)
+
+// Endpoint turns a notion API path into a label by replacing page and block
+// ids, e.g. /v1/blocks/:id/children.
+func Endpoint(method, path string) string {
+	return method + " " + notionID.ReplaceAllString(path, ":id")
+}
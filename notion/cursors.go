@@ -1,107 +1,187 @@
 package notion
 
-import "errors"
-
-// sad code, no generic, me copy-paste sad
-
-type PageCursor struct {
-	GetNext func()(PageCursor, error)
-	Current []Page
-
-	Remaining bool
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// list is one page of results from a notion list endpoint.
+type list[T any] struct {
+	Object     string  `json:"object"`
+	Results    []T     `json:"results"`
+	NextCursor *string `json:"next_cursor"`
+	HasMore    bool    `json:"has_more"`
 }
 
-type BlockCursor struct {
-	GetNext func()(BlockCursor, error)
-	Current []Block
+// fetchList makes a request to a list endpoint.
+func fetchList[T any](client Client, method string, path string, body string) (list[T], error) {
+	response, err := client.MakeRequest(method, path, body)
+	if err != nil {
+		return list[T]{}, err
+	}
 
-	Remaining bool
+	var results list[T]
+	if err := json.Unmarshal(response, &results); err != nil {
+		return list[T]{}, err
+	}
+	if results.Object != "list" {
+		return list[T]{}, errors.New("match issue")
+	}
+	return results, nil
 }
 
-type DatabaseCursor struct {
-	GetNext func()(DatabaseCursor, error)
-	Current []Database
+// maxPageSize is the most results notion returns per request.
+const maxPageSize = 100
 
-	Remaining bool
+type cursorOptions struct {
+	pageSize int
+	limit    int
+	prefetch bool
 }
 
-func (cursor *BlockCursor) Next() error {
-	if !cursor.Remaining {
-		cursor.Current = []Block{ }
-		return errors.New("end of list")
-	}
-
-	next, err := cursor.GetNext()
-	if err != nil { return err }
+type CursorOption func(*cursorOptions)
 
-	*cursor = next
-
-	return nil
+// PageSize is how many results each request asks for, at most 100.
+func PageSize(size int) CursorOption {
+	return func(options *cursorOptions) {
+		if size > 0 && size < maxPageSize {
+			options.pageSize = size
+		}
+	}
 }
 
-func (cursor *BlockCursor) ReadAll() []Block {
-	all := cursor.Current
-
-	for cursor.Remaining {
-		err := cursor.Next()
-		if err != nil { return all }
-
-		all = append(all, cursor.Current...)
+// Limit stops the cursor after n results.
+func Limit(n int) CursorOption {
+	return func(options *cursorOptions) {
+		options.limit = n
 	}
-
-	return all
 }
 
-func (cursor *PageCursor) Next() error {
-	if !cursor.Remaining {
-		cursor.Current = []Page{ }
-		return errors.New("end of list")
+// Prefetch requests the next page while the current one is being read.
+func Prefetch() CursorOption {
+	return func(options *cursorOptions) {
+		options.prefetch = true
 	}
-
-	next, err := cursor.GetNext()
-	if err != nil { return err }
-
-	*cursor = next
-
-	return nil
 }
 
-func (cursor *PageCursor) ReadAll() []Page {
-	all := cursor.Current
+// Cursor pages through the results of a notion list endpoint, requesting a
+// page at a time with the context of the client it came from:
+//
+//	cursor := client.GetChildren(id)
+//	for cursor.Next() {
+//		for _, block := range cursor.Current { ... }
+//	}
+//	if err := cursor.Err(); err != nil { ... }
+type Cursor[T any] struct {
+	// Current is the page of results the last Next fetched.
+	Current []T
+
+	ctx     context.Context
+	fetch   func(start *string, size int) (list[T], error)
+	options cursorOptions
+
+	start   *string
+	read    int
+	done    bool
+	err     error
+	pending chan fetched[T]
+}
 
-	for cursor.Remaining {
-		err := cursor.Next()
-		if err != nil { return all }
+type fetched[T any] struct {
+	list list[T]
+	err  error
+}
 
-		all = append(all, cursor.Current...)
+func newCursor[T any](client Client, fetch func(client Client, start *string, size int) (list[T], error), options []CursorOption) *Cursor[T] {
+	cursor := &Cursor[T]{
+		ctx:     client.context(),
+		options: cursorOptions{pageSize: maxPageSize},
 	}
-
-	return all
+	for _, option := range options {
+		option(&cursor.options)
+	}
+	cursor.fetch = func(start *string, size int) (list[T], error) {
+		return fetch(client, start, size)
+	}
+	return cursor
 }
 
-func (cursor *DatabaseCursor) Next() error {
-	if !cursor.Remaining {
-		cursor.Current = []Database{ }
-		return errors.New("end of list")
+// Next fetches the next page into Current. It returns false once every
+// result or the limit has been read, or when a request failed or the context
+// was cancelled, in which case Err says why.
+func (cursor *Cursor[T]) Next() bool {
+	cursor.Current = nil
+	if cursor.done || cursor.err != nil {
+		return false
+	}
+	if err := cursor.ctx.Err(); err != nil {
+		cursor.err = err
+		return false
 	}
 
-	next, err := cursor.GetNext()
-	if err != nil { return err }
+	var result fetched[T]
+	if cursor.pending != nil {
+		select {
+		case result = <-cursor.pending:
+		case <-cursor.ctx.Done():
+			result.err = cursor.ctx.Err()
+		}
+		cursor.pending = nil
+	} else {
+		result.list, result.err = cursor.fetch(cursor.start, cursor.size())
+	}
+	if result.err != nil {
+		cursor.err = result.err
+		return false
+	}
 
-	*cursor = next
+	results := result.list.Results
+	if limit := cursor.options.limit; limit > 0 && cursor.read+len(results) > limit {
+		results = results[:limit-cursor.read]
+	}
+	cursor.Current = results
+	cursor.read += len(results)
+	cursor.start = result.list.NextCursor
+	cursor.done = !result.list.HasMore || cursor.start == nil ||
+		(cursor.options.limit > 0 && cursor.read >= cursor.options.limit)
+
+	if !cursor.done && cursor.options.prefetch {
+		// buffered so the request finishes even if nobody calls Next again
+		pending := make(chan fetched[T], 1)
+		start, size := cursor.start, cursor.size()
+		go func() {
+			var result fetched[T]
+			result.list, result.err = cursor.fetch(start, size)
+			pending <- result
+		}()
+		cursor.pending = pending
+	}
 
-	return nil
+	return true
 }
 
-func (cursor *DatabaseCursor) ReadAll() []Database {
-	all := cursor.Current
+// size is the page size of the next request, never more than the limit
+// leaves to read.
+func (cursor *Cursor[T]) size() int {
+	size := cursor.options.pageSize
+	if limit := cursor.options.limit; limit > 0 && limit-cursor.read < size {
+		size = limit - cursor.read
+	}
+	return size
+}
 
-	for cursor.Remaining {
-		err := cursor.Next()
-		if err != nil { return all }
+// Err is the error that stopped the cursor, if any.
+func (cursor *Cursor[T]) Err() error {
+	return cursor.err
+}
 
+// All reads every remaining result. On error the results read so far are
+// returned with it.
+func (cursor *Cursor[T]) All() ([]T, error) {
+	var all []T
+	for cursor.Next() {
 		all = append(all, cursor.Current...)
 	}
-
-	return all
+	return all, cursor.Err()
 }
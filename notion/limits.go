@@ -0,0 +1,127 @@
+package notion
+
+import "unicode/utf16"
+
+const (
+	// maxBlocks is the most blocks notion takes in one request.
+	maxBlocks = 100
+
+	// maxTextLength is the most characters notion takes in one rich text
+	// object, counted in UTF-16 code units like javascript does.
+	maxTextLength = 2000
+)
+
+// chunkBlocks splits blocks into groups that fit in one request.
+func chunkBlocks(blocks []Block) [][]Block {
+	var chunks [][]Block
+	for len(blocks) > maxBlocks {
+		chunks = append(chunks, blocks[:maxBlocks])
+		blocks = blocks[maxBlocks:]
+	}
+	return append(chunks, blocks)
+}
+
+// splitBlocks returns copies of blocks with their text split to fit notion's
+// limits, see splitText.
+func splitBlocks(blocks []Block) []Block {
+	if len(blocks) == 0 {
+		return blocks
+	}
+	split := make([]Block, len(blocks))
+	for i, block := range blocks {
+		split[i] = splitBlock(block)
+	}
+	return split
+}
+
+// splitBlock returns a copy of block with its text split to fit notion's
+// limits, block itself is left untouched.
+func splitBlock(block Block) Block {
+	switch block.Type {
+	case "paragraph":
+		block.Paragraph = splitTextTree(block.Paragraph)
+	case "heading_1":
+		block.Heading1 = splitHeading(block.Heading1)
+	case "heading_2":
+		block.Heading2 = splitHeading(block.Heading2)
+	case "heading_3":
+		block.Heading3 = splitHeading(block.Heading3)
+	case "bulleted_list_item":
+		block.BulletedListItem = splitTextTree(block.BulletedListItem)
+	case "numbered_list_item":
+		block.NumberedListItem = splitTextTree(block.NumberedListItem)
+	case "to_do":
+		if block.ToDo != nil {
+			todo := *block.ToDo
+			todo.Text = splitText(todo.Text)
+			todo.Children = splitBlocks(todo.Children)
+			block.ToDo = &todo
+		}
+	case "toggle":
+		block.Toggle = splitTextTree(block.Toggle)
+	}
+	return block
+}
+
+func splitTextTree(tree *TextTree) *TextTree {
+	if tree == nil {
+		return nil
+	}
+	split := *tree
+	split.Text = splitText(split.Text)
+	split.Children = splitBlocks(split.Children)
+	return &split
+}
+
+func splitHeading(heading *Text) *Text {
+	if heading == nil {
+		return nil
+	}
+	return &Text{Text: splitText(heading.Text)}
+}
+
+// splitText breaks every text longer than notion allows into consecutive
+// pieces with the same annotations and link, which read the same once
+// rendered. A block holds at most 100 pieces, 200,000 characters, which is
+// well over the 40,000 characters of a slack message.
+func splitText(text []RichText) []RichText {
+	if text == nil {
+		return nil
+	}
+
+	split := make([]RichText, 0, len(text))
+	for _, part := range text {
+		if part.Text == nil {
+			split = append(split, part)
+			continue
+		}
+
+		for _, content := range splitContent(part.Text.Content) {
+			info := *part.Text
+			info.Content = content
+			piece := part
+			piece.Text = &info
+			split = append(split, piece)
+		}
+	}
+	return split
+}
+
+// splitContent cuts content into pieces of at most maxTextLength, never in
+// the middle of a character.
+func splitContent(content string) []string {
+	var pieces []string
+	start, length := 0, 0
+	for i, r := range content {
+		size := utf16.RuneLen(r)
+		if size < 0 {
+			size = 1
+		}
+		if length+size > maxTextLength {
+			pieces = append(pieces, content[start:i])
+			start, length = i, 0
+		}
+		length += size
+	}
+	return append(pieces, content[start:])
+}
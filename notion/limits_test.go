@@ -0,0 +1,112 @@
+package notion
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func paragraph(content string) Block {
+	return Block{
+		Object: "block",
+		Type:   "paragraph",
+		Paragraph: &TextTree{
+			Text: []RichText{{Type: "text", Text: &TextInfo{Content: content}}},
+		},
+	}
+}
+
+func TestChunkBlocks(t *testing.T) {
+	for _, test := range []struct {
+		blocks int
+		want   []int
+	}{
+		{0, []int{0}},
+		{1, []int{1}},
+		{100, []int{100}},
+		{101, []int{100, 1}},
+		{250, []int{100, 100, 50}},
+	} {
+		chunks := chunkBlocks(make([]Block, test.blocks))
+		var sizes []int
+		for _, chunk := range chunks {
+			sizes = append(sizes, len(chunk))
+		}
+		if len(sizes) != len(test.want) {
+			t.Errorf("chunkBlocks(%d) = %v, want %v", test.blocks, sizes, test.want)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != test.want[i] {
+				t.Errorf("chunkBlocks(%d) = %v, want %v", test.blocks, sizes, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitContent(t *testing.T) {
+	a := strings.Repeat("a", 1999)
+	for _, test := range []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", []string{""}},
+		{"at the limit", a + "b", []string{a + "b"}},
+		{"over the limit", a + "bc", []string{a + "b", "c"}},
+		// an emoji is two UTF-16 units, it can't be cut in half
+		{"surrogate pair at the limit", a[1:] + "😀", []string{a[1:] + "😀"}},
+		{"surrogate pair across the limit", a + "😀b", []string{a, "😀b"}},
+		{"several pieces", strings.Repeat("é", 4500), []string{
+			strings.Repeat("é", 2000), strings.Repeat("é", 2000), strings.Repeat("é", 500),
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pieces := splitContent(test.content)
+			if strings.Join(pieces, "") != test.content {
+				t.Fatal("pieces don't add up to the content")
+			}
+			if len(pieces) != len(test.want) {
+				t.Fatalf("got %d pieces, want %d", len(pieces), len(test.want))
+			}
+			for i, piece := range pieces {
+				if piece != test.want[i] {
+					t.Errorf("piece %d is %d units, want %d", i, units(piece), units(test.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func units(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func TestSplitBlock(t *testing.T) {
+	link := &Link{URL: "https://example.com"}
+	block := paragraph(strings.Repeat("x", 4001))
+	block.Paragraph.Text[0].Annotations = &Annotations{Bold: true}
+	block.Paragraph.Text[0].Text.Link = link
+	block.Paragraph.Children = []Block{paragraph(strings.Repeat("y", 2001))}
+
+	split := splitBlock(block)
+
+	text := split.Paragraph.Text
+	if len(text) != 3 {
+		t.Fatalf("got %d pieces, want 3", len(text))
+	}
+	for i, piece := range text {
+		if !piece.Annotations.Bold || piece.Text.Link != link {
+			t.Errorf("piece %d lost its annotations or link", i)
+		}
+	}
+	if len(split.Paragraph.Children[0].Paragraph.Text) != 2 {
+		t.Error("children weren't split")
+	}
+
+	// the original is left alone
+	if len(block.Paragraph.Text) != 1 || len(block.Paragraph.Text[0].Text.Content) != 4001 {
+		t.Error("block was modified")
+	}
+}
@@ -1,6 +1,7 @@
 package notion
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -9,12 +10,34 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"backlink/logger"
+	"backlink/metrics"
+	"backlink/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Client struct {
 	Client  *http.Client
 	Token   string
 	Version string
+
+	ctx context.Context
+}
+
+// WithContext returns a copy of the client whose requests are made, and
+// logged, with ctx.
+func (client Client) WithContext(ctx context.Context) Client {
+	client.ctx = ctx
+	return client
+}
+
+func (client Client) context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
 }
 
 type PageTitle struct {
@@ -135,8 +158,24 @@ func (client Client) MakeRequest(method string, path string, body string) ([]byt
 	retries := 0
 	var response *http.Response
 
+	endpoint := path
+	if u, err := url.Parse(path); err == nil {
+		endpoint = u.Path
+	}
+	endpoint = metrics.Endpoint(method, endpoint)
+
+	ctx, span := tracing.Start(client.context(), "notion "+endpoint, attribute.String("http.method", method))
+	log := logger.FromContext(ctx)
+	start := time.Now()
+	var err error
+	defer func() {
+		metrics.NotionDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}()
+
 	for {
-		request, err := http.NewRequest(method, path, strings.NewReader(body))
+		var request *http.Request
+		request, err = http.NewRequestWithContext(ctx, method, path, strings.NewReader(body))
 		if err != nil {
 			return []byte{}, err
 		}
@@ -147,31 +186,57 @@ func (client Client) MakeRequest(method string, path string, body string) ([]byt
 
 		response, err = client.Client.Do(request)
 		if err != nil {
+			metrics.NotionRequests.WithLabelValues(endpoint, "error").Inc()
+			log.Warn("notion request failed", "endpoint", endpoint, "err", err)
 			return []byte{}, err
 		}
+		metrics.NotionRequests.WithLabelValues(endpoint, strconv.Itoa(response.StatusCode)).Inc()
+		log.Debug("notion request", "endpoint", endpoint, "status", response.StatusCode, "duration", time.Since(start))
 
-		// Rate Limit? Try Again
+		// Rate Limit? Wait as long as notion asks and try again
 		if response.StatusCode == 429 && retries < 3 {
 			retries += 1
-			time.Sleep(1000)
+			response.Body.Close()
+			wait := retryAfter(response, retries)
+			log.Info("notion rate limited", "endpoint", endpoint, "wait", wait)
+			metrics.Retries.WithLabelValues("notion").Inc()
+			metrics.RateLimitWait.WithLabelValues("notion").Add(wait.Seconds())
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				err = ctx.Err()
+				return []byte{}, err
+			}
 		} else {
 			break
 		}
 	}
+	defer response.Body.Close()
 
 	out, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return []byte{}, err
 	}
 
+	span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
 	if response.StatusCode != 200 {
 		message := "status code " + strconv.Itoa(response.StatusCode) + ": " + string(out)
-		return []byte{}, errors.New(message)
+		err = errors.New(message)
+		return []byte{}, err
 	}
 
 	return out, nil
 }
 
+// retryAfter reads the Retry-After header of a rate limited response, backing
+// off by attempt when it is missing.
+func retryAfter(response *http.Response, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(attempt) * time.Second
+}
+
 func (client Client) GetPage(id string) (Page, error) {
 	path := "https://api.notion.com/v1/pages/" + id
 	body, err := client.MakeRequest("GET", path, "")
@@ -191,59 +256,56 @@ func (client Client) GetPage(id string) (Page, error) {
 	return page, nil
 }
 
-func (client Client) GetChildrenFrom(id string, from *string, size int) (BlockCursor, error) {
-	path := "https://api.notion.com/v1/blocks/" + id + "/children"
-
-	queries := map[string]string{
-		"page_size": strconv.Itoa(size),
-	}
+// GetChildren lists the blocks inside a page or block.
+func (client Client) GetChildren(id string, options ...CursorOption) *Cursor[Block] {
+	return newCursor(client, func(client Client, start *string, size int) (list[Block], error) {
+		queries := map[string]string{
+			"page_size": strconv.Itoa(size),
+		}
+		if start != nil {
+			queries["start_cursor"] = *start
+		}
 
-	if from != nil {
-		queries["start_cursor"] = *from
-	}
+		path := "https://api.notion.com/v1/blocks/" + id + "/children" + QueryString(queries)
+		return fetchList[Block](client, "GET", path, "")
+	}, options)
+}
 
-	path += QueryString(queries)
+// AppendChildren adds blocks to the end of a page or block and returns them
+// as created. Text over notion's length limit is split and more than 100
+// blocks are sent in several requests; if one of them fails the blocks
+// created so far are returned with the error.
+func (client Client) AppendChildren(id string, blocks []Block) ([]Block, error) {
+	// id -> parent block/page
+	path := "https://api.notion.com/v1/blocks/" + id + "/children"
 
-	body, err := client.MakeRequest("GET", path, "")
-	if err != nil {
-		return BlockCursor{}, err
-	}
+	var created []Block
+	for _, chunk := range chunkBlocks(splitBlocks(blocks)) {
+		value := struct {
+			Children []Block `json:"children"`
+		}{
+			Children: chunk,
+		}
 
-	var data struct {
-		Object     string
-		Results    []Block
-		NextCursor *string
-		HasMore    bool
-	}
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		return BlockCursor{}, err
-	}
-	if data.Object != "list" {
-		return BlockCursor{}, errors.New("match issue")
-	}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return created, err
+		}
 
-	next := func() (BlockCursor, error) {
-		return client.GetChildrenFrom(id, data.NextCursor, size)
+		results, err := fetchList[Block](client, "PATCH", path, string(data))
+		if err != nil {
+			return created, err
+		}
+		created = append(created, results.Results...)
 	}
 
-	return BlockCursor{
-		GetNext:   next,
-		Current:   data.Results,
-		Remaining: data.HasMore,
-	}, nil
-}
-
-func (client Client) GetChildren(id string) (BlockCursor, error) {
-	return client.GetChildrenFrom(id, nil, 50)
+	return created, nil
 }
 
-func (client Client) AppendChildren(id string, blocks []Block) (Block, error) {
-	// First Block Only :think:
-	value := struct {
-		Children []Block `json:"children"`
-	}{
-		Children: blocks,
+func (client Client) UpdateBlock(id string, block Block) (Block, error) {
+	block = splitBlock(block)
+	value := map[string]interface{}{
+		block.Type: block.Body(),
 	}
 
 	data, err := json.Marshal(value)
@@ -251,23 +313,25 @@ func (client Client) AppendChildren(id string, blocks []Block) (Block, error) {
 		return Block{}, err
 	}
 
-	// id -> parent block/page
-	path := "https://api.notion.com/v1/blocks/" + id + "/children"
+	path := "https://api.notion.com/v1/blocks/" + id
 	body, err := client.MakeRequest("PATCH", path, string(data))
 	if err != nil {
 		return Block{}, err
 	}
 
-	var block Block
-	err = json.Unmarshal(body, &block)
+	var updated Block
+	err = json.Unmarshal(body, &updated)
 	if err != nil {
 		return Block{}, err
 	}
-	if block.Object != "block" {
-		return Block{}, errors.New("match issue")
-	}
 
-	return block, nil
+	return updated, nil
+}
+
+func (client Client) DeleteBlock(id string) error {
+	path := "https://api.notion.com/v1/blocks/" + id
+	_, err := client.MakeRequest("DELETE", path, "")
+	return err
 }
 
 func (client Client) GetDatabase(id string) (Database, error) {
@@ -287,108 +351,76 @@ func (client Client) GetDatabase(id string) (Database, error) {
 	return database, nil
 }
 
-func (client Client) GetDatabasePagesFrom(id string, from *string, size int) (PageCursor, error) {
-	path := "https://api.notion.com/v1/databases/" + id + "/query"
-
-	pages := struct {
-		StartCursor *string `json:"start_cursor,omitempty"`
-		PageSize    int     `json:"page_size"`
-	}{
-		StartCursor: from,
-		PageSize:    size,
-	}
-
-	body, err := json.Marshal(pages)
-	if err != nil {
-		return PageCursor{}, err
-	}
-
-	response, err := client.MakeRequest("POST", path, string(body))
-	if err != nil {
-		return PageCursor{}, err
-	}
-
-	var info struct {
-		Object     string
-		Results    []Page
-		NextCursor *string
-		HasMore    bool
-	}
-
-	err = json.Unmarshal(response, &info)
-	if err != nil {
-		return PageCursor{}, err
-	}
-	if info.Object != "list" {
-		return PageCursor{}, errors.New("match issue")
-	}
-
-	next := func() (PageCursor, error) {
-		return client.GetDatabasePagesFrom(id, info.NextCursor, size)
-	}
+// GetDatabasePages lists the pages in a database.
+func (client Client) GetDatabasePages(id string, options ...CursorOption) *Cursor[Page] {
+	return newCursor(client, func(client Client, start *string, size int) (list[Page], error) {
+		params := struct {
+			StartCursor *string `json:"start_cursor,omitempty"`
+			PageSize    int     `json:"page_size"`
+		}{
+			StartCursor: start,
+			PageSize:    size,
+		}
 
-	return PageCursor{
-		GetNext:   next,
-		Current:   info.Results,
-		Remaining: info.HasMore,
-	}, nil
-}
+		body, err := json.Marshal(params)
+		if err != nil {
+			return list[Page]{}, err
+		}
 
-func (client Client) GetDatabasePages(id string) (PageCursor, error) {
-	return client.GetDatabasePagesFrom(id, nil, 50)
+		path := "https://api.notion.com/v1/databases/" + id + "/query"
+		return fetchList[Page](client, "POST", path, string(body))
+	}, options)
 }
 
-// GetDatabasesFrom does not work
-func (client Client) GetDatabasesFrom(from *string, size int) (DatabaseCursor, error) {
-	path := "https://api.notion.com/v1/databases"
-
-	queries := map[string]string{
-		"page_size": strconv.Itoa(size),
-	}
-
-	if from != nil {
-		queries["start_cursor"] = *from
-	}
-
-	path += QueryString(queries)
-
-	data, err := client.MakeRequest("GET", path, "")
-	if err != nil {
-		return DatabaseCursor{}, err
-	}
-
-	var info struct {
-		Object     string
-		Results    []Database
-		NextCursor *string
-		HasMore    bool
-	}
+// GetDatabases does not work
+func (client Client) GetDatabases(options ...CursorOption) *Cursor[Database] {
+	return newCursor(client, func(client Client, start *string, size int) (list[Database], error) {
+		queries := map[string]string{
+			"page_size": strconv.Itoa(size),
+		}
+		if start != nil {
+			queries["start_cursor"] = *start
+		}
 
-	err = json.Unmarshal(data, &info)
-	if err != nil {
-		return DatabaseCursor{}, err
-	}
-	if info.Object != "list" {
-		return DatabaseCursor{}, errors.New("match issue")
-	}
+		path := "https://api.notion.com/v1/databases" + QueryString(queries)
+		return fetchList[Database](client, "GET", path, "")
+	}, options)
+}
 
-	next := func() (DatabaseCursor, error) {
-		return client.GetDatabasesFrom(info.NextCursor, size)
-	}
+// SearchPages lists the pages shared with the integration whose title
+// matches query, an empty query matches every page.
+func (client Client) SearchPages(query string, options ...CursorOption) *Cursor[Page] {
+	return newCursor(client, func(client Client, start *string, size int) (list[Page], error) {
+		params := struct {
+			Query       string  `json:"query,omitempty"`
+			StartCursor *string `json:"start_cursor,omitempty"`
+			PageSize    int     `json:"page_size"`
+			Filter      struct {
+				Value    string `json:"value"`
+				Property string `json:"property"`
+			} `json:"filter"`
+		}{
+			Query:       query,
+			StartCursor: start,
+			PageSize:    size,
+		}
+		params.Filter.Value = "page"
+		params.Filter.Property = "object"
 
-	return DatabaseCursor{
-		GetNext:   next,
-		Current:   info.Results,
-		Remaining: info.HasMore,
-	}, nil
-}
+		body, err := json.Marshal(params)
+		if err != nil {
+			return list[Page]{}, err
+		}
 
-// GetDatabases does not work
-func (client Client) GetDatabases() (DatabaseCursor, error) {
-	return client.GetDatabasesFrom(nil, 50)
+		return fetchList[Page](client, "POST", "https://api.notion.com/v1/search", string(body))
+	}, options)
 }
 
+// CreatePageWithBlocks creates a page under parentPageId. Blocks past the 100
+// notion takes with the page are appended to it afterwards.
 func (client Client) CreatePageWithBlocks(parentPageId string, title string, blocks []Block) (Page, error) {
+	chunks := chunkBlocks(splitBlocks(blocks))
+
 	type PageParent struct {
 		PageId string `json:"page_id"`
 	}
@@ -425,7 +457,7 @@ func (client Client) CreatePageWithBlocks(parentPageId string, title string, blo
 		Properties: PageNameProperties{
 			Title: titleProperty,
 		},
-		Children: blocks,
+		Children: chunks[0],
 	}
 
 	paramsText, err := json.Marshal(params)
@@ -447,6 +479,12 @@ func (client Client) CreatePageWithBlocks(parentPageId string, title string, blo
 		return Page{}, err
 	}
 
+	for _, chunk := range chunks[1:] {
+		if _, err := client.AppendChildren(*page.Id, chunk); err != nil {
+			return page, err
+		}
+	}
+
 	return page, nil
 }
 
@@ -456,8 +494,9 @@ func (client Client) CreatePage(parentPageId string, title string) (Page, error)
 
 func NewClient(token string) Client {
 	return Client{
-		Client:  &http.Client{},
-		Token:   token,
-		Version: "2021-05-13",
+		Client: &http.Client{},
+		Token:  token,
+		// appending children returns the created blocks since 2021-08-16
+		Version: "2021-08-16",
 	}
 }
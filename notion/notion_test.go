@@ -0,0 +1,105 @@
+package notion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type roundTripper func(request *http.Request) (*http.Response, error)
+
+func (fn roundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	return fn(request)
+}
+
+// fakeAppend answers append requests with a block per child until fail
+// requests have been made, then with an error. It records the size of every
+// request.
+func fakeAppend(t *testing.T, fail int, sizes *[]int) Client {
+	client := NewClient("token")
+	client.Client = &http.Client{Transport: roundTripper(func(request *http.Request) (*http.Response, error) {
+		var body struct {
+			Children []Block `json:"children"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		*sizes = append(*sizes, len(body.Children))
+
+		status, out := http.StatusOK, []byte(`{"object":"error","message":"invalid"}`)
+		if len(*sizes) == fail {
+			status = http.StatusBadRequest
+		} else {
+			created := list[Block]{Object: "list", Results: body.Children}
+			for i := range created.Results {
+				id := strconv.Itoa(len(*sizes)) + "-" + strconv.Itoa(i)
+				created.Results[i].Id = &id
+			}
+			out, _ = json.Marshal(created)
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(strings.NewReader(string(out))),
+			Header:     http.Header{},
+		}, nil
+	})}
+	return client
+}
+
+func TestAppendChildren(t *testing.T) {
+	blocks := make([]Block, 250)
+	for i := range blocks {
+		blocks[i] = paragraph(strconv.Itoa(i))
+	}
+
+	var sizes []int
+	created, err := fakeAppend(t, 0, &sizes).AppendChildren("page", blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 250 || len(sizes) != 3 || sizes[0] != 100 || sizes[1] != 100 || sizes[2] != 50 {
+		t.Fatalf("created %d blocks in requests of %v", len(created), sizes)
+	}
+	// blocks come back in order
+	if created[100].GetText()[0].Text.Content != "100" {
+		t.Errorf("block 100 = %+v", created[100])
+	}
+}
+
+func TestAppendChildrenPartialFailure(t *testing.T) {
+	blocks := make([]Block, 250)
+	for i := range blocks {
+		blocks[i] = paragraph(strconv.Itoa(i))
+	}
+
+	var sizes []int
+	created, err := fakeAppend(t, 2, &sizes).AppendChildren("page", blocks)
+	if err == nil {
+		t.Fatal("failed request wasn't reported")
+	}
+	// the first chunk was created and is returned, nothing after the
+	// failure is sent
+	if len(created) != 100 || *created[99].Id != "1-99" {
+		t.Fatalf("created %d blocks, want the first 100", len(created))
+	}
+	if len(sizes) != 2 {
+		t.Errorf("made %d requests, want 2", len(sizes))
+	}
+}
+
+func TestAppendChildrenSplitsText(t *testing.T) {
+	var sizes []int
+	client := fakeAppend(t, 0, &sizes)
+	created, err := client.AppendChildren("page", []Block{paragraph(strings.Repeat("a", 1999) + "😀")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := created[0].GetText()
+	if len(text) != 2 || text[0].Text.Content != strings.Repeat("a", 1999) || text[1].Text.Content != "😀" {
+		t.Errorf("sent text in %d pieces", len(text))
+	}
+}
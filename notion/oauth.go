@@ -0,0 +1,82 @@
+package notion
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type OAuthToken struct {
+	AccessToken   string `json:"access_token"`
+	BotId         string `json:"bot_id"`
+	WorkspaceId   string `json:"workspace_id"`
+	WorkspaceName string `json:"workspace_name"`
+	WorkspaceIcon string `json:"workspace_icon"`
+}
+
+// AuthorizeURL is where a user is sent to add the public integration to their
+// notion workspace.
+func AuthorizeURL(clientId string, redirectURI string, state string) string {
+	query := url.Values{
+		"client_id":     {clientId},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"owner":         {"user"},
+		"state":         {state},
+	}
+
+	return "https://api.notion.com/v1/oauth/authorize?" + query.Encode()
+}
+
+// ExchangeCode trades the code notion redirects back with for an access token.
+func ExchangeCode(clientId string, clientSecret string, code string, redirectURI string) (OAuthToken, error) {
+	params := struct {
+		GrantType   string `json:"grant_type"`
+		Code        string `json:"code"`
+		RedirectURI string `json:"redirect_uri"`
+	}{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: redirectURI,
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	request, err := http.NewRequest("POST", "https://api.notion.com/v1/oauth/token", strings.NewReader(string(data)))
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	request.SetBasicAuth(clientId, clientSecret)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	if response.StatusCode != 200 {
+		return OAuthToken{}, errors.New("status code " + strconv.Itoa(response.StatusCode) + ": " + string(body))
+	}
+
+	var token OAuthToken
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	return token, nil
+}
@@ -1,12 +1,16 @@
 package notion
 
 import (
+	"errors"
 	"strings"
 )
 
 type InterfaceElement struct {
 	Text string
 	Block Block
+
+	// Children is whatever is nested below the element.
+	Children []Node
 }
 
 type InterfaceSection struct {
@@ -26,6 +30,10 @@ type InterfacePage struct {
 	Title string
 	Children []InterfacePage
 	Sections []InterfaceSection
+
+	// Loaded is false for child pages whose content wasn't fetched, until
+	// Reload is called on them.
+	Loaded bool
 }
 
 type Session struct {
@@ -48,6 +56,21 @@ func (block Block) GetText() []RichText {
 	return nil
 }
 
+func (block Block) Body() interface{} {
+	switch block.Type {
+	case "paragraph": return block.Paragraph
+	case "heading_1": return block.Heading1
+	case "heading_2": return block.Heading2
+	case "heading_3": return block.Heading3
+	case "bulleted_list_item": return block.BulletedListItem
+	case "numbered_list_item": return block.NumberedListItem
+	case "to_do": return block.ToDo
+	case "toggle": return block.Toggle
+	}
+
+	return nil
+}
+
 func (block Block) TypeHasChildren() bool {
 	switch block.Type {
 	case "paragraph": return true
@@ -72,48 +95,46 @@ func Flatten(objects []RichText) string {
 	return builder.String()
 }
 
-func ParseSections(client Client, blocks []Block) ([]InterfaceSection, []InterfacePage, error) {
+// ParseSections splits a page's block tree into sections, one for each top
+// level block that can hold children, and the pages nested in it. Child pages
+// whose content wasn't fetched are left for Reload.
+func ParseSections(client Client, nodes []Node) ([]InterfaceSection, []InterfacePage) {
 	var children []InterfacePage
 	var sections []InterfaceSection
 
-	var index = 0
-
-	for index < len(blocks) {
-		block := blocks[index]
+	for _, node := range nodes {
+		block := node.Block
 
 		if block.Type == "child_page" {
 			page := InterfacePage {
 				Client: client,
 				Id: *block.Id,
+				Loaded: node.Loaded,
 			}
+			if block.ChildPage != nil { page.Title = block.ChildPage.Title }
 
-			err := page.Reload()
-			if err != nil { return nil, nil, err }
+			if node.Loaded {
+				page.Sections, page.Children = ParseSections(client, node.Children)
+			}
 
 			children = append(children, page)
 		} else if block.TypeHasChildren() {
 			var elements []InterfaceElement
 
-			if block.HasChildren {
-				cursor, err := client.GetChildren(*block.Id)
-				if err != nil { return nil, nil, err }
-
-				children := cursor.ReadAll()
+			for _, child := range node.Children {
+				text := child.Block.GetText()
 
-				for _, element := range children {
-					text := element.GetText()
+				var flattened string
 
-					var flattened string
-
-					if text != nil {
-						flattened = Flatten(text)
-					}
-
-					elements = append(elements, InterfaceElement{
-						Text:  flattened,
-						Block: element,
-					})
+				if text != nil {
+					flattened = Flatten(text)
 				}
+
+				elements = append(elements, InterfaceElement{
+					Text:  flattened,
+					Block: child.Block,
+					Children: child.Children,
+				})
 			}
 
 			sections = append(sections, InterfaceSection {
@@ -124,16 +145,17 @@ func ParseSections(client Client, blocks []Block) ([]InterfaceSection, []Interfa
 				Elements: elements,
 			})
 		}
-
-		index++
 	}
 
-	return sections, children, nil
+	return sections, children
 }
 
 func (section *InterfaceSection) AppendBlock(block Block) (InterfaceElement, error) {
-	value, err := section.Client.AppendChildren(*section.Head.Id, []Block { block })
+	values, err := section.Client.AppendChildren(*section.Head.Id, []Block { block })
 	if err != nil { return InterfaceElement {}, err }
+	if len(values) == 0 { return InterfaceElement {}, errors.New("no block appended") }
+
+	value := values[0]
 
 	element := InterfaceElement {
 		Text: Flatten(value.GetText()),
@@ -165,7 +187,7 @@ func (section *InterfaceSection) AppendElement(description string) (InterfaceEle
 }
 
 func (page *InterfacePage) AppendSection(description string, heading string) (InterfaceSection, error) {
-	// Append Children only returns one block... makes me feel like I have to insert them separately
+	var blocks []Block
 
 	if len(heading) > 0 {
 		headingBlock := Block {
@@ -183,8 +205,7 @@ func (page *InterfacePage) AppendSection(description string, heading string) (In
 			},
 		}
 
-		_, err := page.Client.AppendChildren(page.Id, []Block { headingBlock })
-		if err != nil { return InterfaceSection {}, err }
+		blocks = append(blocks, headingBlock)
 	}
 
 	startBlock := Block {
@@ -202,13 +223,18 @@ func (page *InterfacePage) AppendSection(description string, heading string) (In
 		},
 	}
 
-	block, err := page.Client.AppendChildren(page.Id, []Block { startBlock })
+	blocks = append(blocks, startBlock)
+
+	created, err := page.Client.AppendChildren(page.Id, blocks)
 	if err != nil { return InterfaceSection {}, err }
+	if len(created) != len(blocks) { return InterfaceSection {}, errors.New("missing appended blocks") }
+
+	block := created[len(created)-1]
 
 	section := InterfaceSection {
 		Client: page.Client,
 
-		Head: block, // Might not have a lot of data :)
+		Head: block,
 		Title: Flatten(block.GetText()),
 		Elements: nil, // no sub elements yet hopefully D:
 	}
@@ -238,27 +264,25 @@ func (page *InterfacePage) AppendPage(title string) (InterfacePage, error) {
 	return page.AppendPageWithBlocks(title, []Block { })
 }
 
-func (page *InterfacePage) Reload() error {
+// Reload fetches the page's title and block tree, see GetTree for the
+// options.
+func (page *InterfacePage) Reload(options ...TreeOption) error {
 	value, err := page.Client.GetPage(page.Id)
 	if err != nil { return err }
 
 	page.Title = Flatten(value.Properties.Title.Title)
 
-	cursor, err := page.Client.GetChildren(page.Id)
-	if err != nil { return err }
-
-	blocks := cursor.ReadAll()
-
-	sections, children, err := ParseSections(page.Client, blocks)
+	nodes, err := page.Client.GetTree(page.Id, options...)
 	if err != nil { return err }
 
-	page.Sections = sections
-	page.Children = children
+	page.Sections, page.Children = ParseSections(page.Client, nodes)
+	page.Loaded = true
 
 	return nil
 }
 
-func NewSession(client Client, pageIds []string) (Session, error) {
+// NewSession loads the root pages, passing options on to Reload.
+func NewSession(client Client, pageIds []string, options ...TreeOption) (Session, error) {
 	var pages []InterfacePage
 
 	for _, id := range pageIds {
@@ -267,7 +291,7 @@ func NewSession(client Client, pageIds []string) (Session, error) {
 			Id: id,
 		}
 
-		err := page.Reload()
+		err := page.Reload(options...)
 		if err != nil { return Session {}, err }
 
 		pages = append(pages, page)
@@ -0,0 +1,154 @@
+package notion
+
+import (
+	"context"
+	"sync"
+)
+
+// Node is a block with the blocks nested inside it.
+type Node struct {
+	Block    Block
+	Children []Node
+
+	// Loaded is false when the block has children that weren't fetched,
+	// because it is below the depth limit or a child page of a lazy walk.
+	Loaded bool
+}
+
+// defaultParallelism keeps a walk close to notion's rate limit of three
+// requests a second.
+const defaultParallelism = 3
+
+type treeOptions struct {
+	depth       int
+	parallelism int
+	lazy        bool
+}
+
+type TreeOption func(*treeOptions)
+
+// Depth stops the walk n levels below the page, by default the whole tree is
+// fetched.
+func Depth(n int) TreeOption {
+	return func(options *treeOptions) {
+		options.depth = n
+	}
+}
+
+// Parallelism is how many requests the walk makes at once, 3 by default.
+func Parallelism(n int) TreeOption {
+	return func(options *treeOptions) {
+		if n > 0 {
+			options.parallelism = n
+		}
+	}
+}
+
+// LazyPages leaves child pages unfetched, their content can be loaded later
+// with InterfacePage.Reload.
+func LazyPages() TreeOption {
+	return func(options *treeOptions) {
+		options.lazy = true
+	}
+}
+
+// GetTree fetches the blocks of a page or block and everything nested in
+// them. Blocks are fetched in parallel but returned in page order; the first
+// failed request cancels the rest of the walk.
+func (client Client) GetTree(id string, options ...TreeOption) ([]Node, error) {
+	ctx, cancel := context.WithCancel(client.context())
+	defer cancel()
+
+	walker := &walker{
+		client: client.WithContext(ctx),
+		ctx:    ctx,
+		cancel: cancel,
+		options: treeOptions{
+			parallelism: defaultParallelism,
+		},
+	}
+	for _, option := range options {
+		option(&walker.options)
+	}
+	walker.slots = make(chan struct{}, walker.options.parallelism)
+
+	var nodes []Node
+	walker.wg.Add(1)
+	walker.walk(id, 1, &nodes)
+	walker.wg.Wait()
+
+	if walker.err != nil {
+		return nil, walker.err
+	}
+	return nodes, nil
+}
+
+type walker struct {
+	client  Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	options treeOptions
+
+	// slots bounds the requests in flight, a slot is only held while
+	// fetching so waiting on children never blocks the walk.
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// walk fetches the children of id into *into and walks each of them that
+// has children of its own in a new goroutine.
+func (walker *walker) walk(id string, depth int, into *[]Node) {
+	defer walker.wg.Done()
+
+	select {
+	case walker.slots <- struct{}{}:
+	case <-walker.ctx.Done():
+		walker.fail(walker.ctx.Err())
+		return
+	}
+	blocks, err := walker.client.GetChildren(id).All()
+	<-walker.slots
+	if err != nil {
+		walker.fail(err)
+		return
+	}
+
+	nodes := make([]Node, len(blocks))
+	for i, block := range blocks {
+		nodes[i].Block = block
+	}
+	*into = nodes
+
+	for i := range nodes {
+		node := &nodes[i]
+		if !walker.descend(node.Block, depth) {
+			node.Loaded = !node.Block.HasChildren && node.Block.Type != "child_page"
+			continue
+		}
+
+		// each goroutine only writes to its own node
+		node.Loaded = true
+		walker.wg.Add(1)
+		go walker.walk(*node.Block.Id, depth+1, &node.Children)
+	}
+}
+
+func (walker *walker) descend(block Block, depth int) bool {
+	if walker.options.depth > 0 && depth >= walker.options.depth {
+		return false
+	}
+	if block.Type == "child_page" {
+		return !walker.options.lazy
+	}
+	return block.HasChildren
+}
+
+func (walker *walker) fail(err error) {
+	walker.once.Do(func() {
+		walker.err = err
+		walker.cancel()
+	})
+}
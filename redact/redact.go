@@ -0,0 +1,166 @@
+package redact
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Detector finds one kind of sensitive text. Valid, when set, gets a final
+// say on each match to cut down false positives.
+type Detector struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Valid   func(match string) bool
+}
+
+// Builtin holds the detectors that can be enabled by name.
+var Builtin = map[string]Detector{
+	"private_key": {
+		Name:    "private_key",
+		Pattern: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	},
+	"slack_token": {
+		Name:    "slack_token",
+		Pattern: regexp.MustCompile(`xox[abposr]-[0-9A-Za-z-]{10,}|xapp-[0-9A-Za-z-]{10,}`),
+	},
+	"aws_key": {
+		Name:    "aws_key",
+		Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	"github_token": {
+		Name:    "github_token",
+		Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[0-9A-Za-z]{36}|github_pat_[0-9A-Za-z_]{22,})\b`),
+	},
+	"google_api_key": {
+		Name:    "google_api_key",
+		Pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`),
+	},
+	"stripe_key": {
+		Name:    "stripe_key",
+		Pattern: regexp.MustCompile(`\b(?:sk|rk)_(?:live|test)_[0-9A-Za-z]{16,}\b`),
+	},
+	"notion_token": {
+		Name:    "notion_token",
+		Pattern: regexp.MustCompile(`\b(?:secret_|ntn_)[0-9A-Za-z]{30,}\b`),
+	},
+	"jwt": {
+		Name:    "jwt",
+		Pattern: regexp.MustCompile(`\beyJ[0-9A-Za-z_-]+\.eyJ[0-9A-Za-z_-]+\.[0-9A-Za-z_-]+`),
+	},
+	"password": {
+		Name:    "password",
+		Pattern: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|api[_-]?key|secret|token)\s*[:=]\s*\S+`),
+	},
+	"email": {
+		Name:    "email",
+		Pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	},
+	"credit_card": {
+		Name:    "credit_card",
+		Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		Valid:   luhn,
+	},
+	"phone": {
+		Name:    "phone",
+		Pattern: regexp.MustCompile(`\+\d{1,3}[ .-]?\(?\d{1,4}\)?(?:[ .-]?\d{2,4}){2,4}\b|\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b`),
+	},
+}
+
+// order runs secrets before the looser patterns so e.g. a token isn't half
+// eaten by the phone number detector first. password goes first so
+// "token: xoxb-..." is counted once.
+var order = []string{
+	"password", "private_key", "slack_token", "aws_key", "github_token", "google_api_key",
+	"stripe_key", "notion_token", "jwt", "email", "credit_card", "phone",
+}
+
+// Redactor replaces everything its detectors find with "[redacted <name>]".
+type Redactor struct {
+	Detectors []Detector
+}
+
+// New builds a redactor from builtin detector names, an empty list meaning
+// all of them, and custom patterns keyed by name.
+func New(builtins []string, custom map[string]string) (*Redactor, error) {
+	redactor := &Redactor{}
+
+	if len(builtins) == 0 {
+		builtins = order
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range builtins {
+		if _, ok := Builtin[name]; !ok {
+			return nil, errors.New("unknown redaction detector " + name)
+		}
+		enabled[name] = true
+	}
+	for _, name := range order {
+		if enabled[name] {
+			redactor.Detectors = append(redactor.Detectors, Builtin[name])
+		}
+	}
+
+	var names []string
+	for name := range custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		re, err := regexp.Compile(custom[name])
+		if err != nil {
+			return nil, errors.New("redaction pattern " + name + ": " + err.Error())
+		}
+		redactor.Detectors = append(redactor.Detectors, Detector{Name: name, Pattern: re})
+	}
+
+	return redactor, nil
+}
+
+// Redact returns text with every match replaced and how many were replaced.
+// A nil Redactor leaves text alone.
+func (redactor *Redactor) Redact(text string) (string, int) {
+	if redactor == nil {
+		return text, 0
+	}
+
+	count := 0
+	for _, detector := range redactor.Detectors {
+		text = detector.Pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if detector.Valid != nil && !detector.Valid(match) {
+				return match
+			}
+			count++
+			return "[redacted " + detector.Name + "]"
+		})
+	}
+
+	return text, count
+}
+
+// luhn checks the card number checksum.
+func luhn(number string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(number)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
@@ -0,0 +1,79 @@
+package schedule
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"backlink/logger"
+)
+
+// Job is something run over and over. Next returns the first time after now
+// it should run.
+type Job struct {
+	Name string
+	Next func(now time.Time) time.Time
+	Run  func(at time.Time)
+}
+
+// Run starts each job in its own goroutine, so a slow job doesn't hold up the
+// others, and returns. A job's runs never overlap.
+func Run(jobs ...Job) {
+	for _, job := range jobs {
+		go loop(job)
+	}
+}
+
+func loop(job Job) {
+	for {
+		at := job.Next(time.Now())
+		logger.Default.Debug("job scheduled", "job", job.Name, "at", at)
+		time.Sleep(time.Until(at))
+		job.Run(at)
+	}
+}
+
+// Daily runs at hour:minute every day in location.
+func Daily(hour, minute int, location *time.Location) func(now time.Time) time.Time {
+	return func(now time.Time) time.Time {
+		now = now.In(location)
+		at := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, location)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at
+	}
+}
+
+// Weekly runs at hour:minute on weekday every week in location.
+func Weekly(weekday time.Weekday, hour, minute int, location *time.Location) func(now time.Time) time.Time {
+	daily := Daily(hour, minute, location)
+	return func(now time.Time) time.Time {
+		at := daily(now)
+		for at.Weekday() != weekday {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at
+	}
+}
+
+// ParseClock parses a time of day like "09:30".
+func ParseClock(clock string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, 0, errors.New("times of day look like 09:30")
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// ParseWeekday parses a weekday name like "monday" or "mon".
+func ParseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || (len(name) >= 3 && strings.HasPrefix(full, name)) {
+			return day, nil
+		}
+	}
+	return 0, errors.New("unknown weekday " + name)
+}
@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backlink/logger"
+	"backlink/markdown"
+)
+
+// Git writes every backlink to its own markdown file inside a git repository
+// and commits after each change. Page ids are file names relative to Dir.
+type Git struct {
+	Dir string
+
+	lock sync.Mutex
+}
+
+var (
+	reposLock sync.Mutex
+	repos     = map[string]*Git{}
+)
+
+// NewGit makes sure dir exists and is a git repository. Every call for the
+// same dir returns the same sink, so the teams of an org install never commit
+// to one repository at the same time.
+func NewGit(dir string) (*Git, error) {
+	reposLock.Lock()
+	defer reposLock.Unlock()
+
+	if sink, ok := repos[dir]; ok {
+		return sink, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	sink := &Git{Dir: dir}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := sink.git(context.Background(), "init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+
+	repos[dir] = sink
+	return sink, nil
+}
+
+// CreatePage treats root as a directory inside the repository. Titles whose
+// file names collide, e.g. "a/b" and "a-b", get a number appended.
+func (sink *Git) CreatePage(ctx context.Context, root string, title string, entry Entry) (string, string, error) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	dir := ""
+	if root != "" {
+		dir = markdown.FileName(root)
+		if err := os.MkdirAll(filepath.Join(sink.Dir, dir), 0755); err != nil {
+			return "", "", err
+		}
+	}
+
+	name := markdown.FileName(title)
+	pageID := filepath.Join(dir, name+".md")
+	for n := 2; sink.exists(pageID); n++ {
+		pageID = filepath.Join(dir, name+" "+strconv.Itoa(n)+".md")
+	}
+
+	entryID := newEntryID()
+	content := markdown.FrontMatter(title, "created", time.Now().UTC().Format(time.RFC3339)) +
+		wrapEntry(entryID, entry)
+
+	if err := sink.write(pageID, content); err != nil {
+		return "", "", err
+	}
+
+	if err := sink.commit(ctx, pageID, "Create "+title); err != nil {
+		// the backlink is released, don't leave a file behind that the next
+		// capture would have to step around
+		sink.git(ctx, "reset", "-q", "--", pageID)
+		os.Remove(filepath.Join(sink.Dir, pageID))
+		return "", "", err
+	}
+	return pageID, entryID, nil
+}
+
+func (sink *Git) AppendEntry(ctx context.Context, pageID string, entry Entry) (string, error) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	content, err := sink.read(pageID)
+	if err != nil {
+		return "", err
+	}
+
+	entryID := newEntryID()
+	content += "\n" + wrapEntry(entryID, entry)
+
+	if err := sink.write(pageID, content); err != nil {
+		return "", err
+	}
+
+	return entryID, sink.commit(ctx, pageID, "Add entry from "+entry.Author)
+}
+
+func (sink *Git) UpdateEntry(ctx context.Context, pageID string, entryID string, entry Entry) error {
+	return sink.replace(ctx, pageID, entryID, wrapEntry(entryID, entry), "Update entry from "+entry.Author)
+}
+
+func (sink *Git) DeleteEntry(ctx context.Context, pageID string, entryID string) error {
+	return sink.replace(ctx, pageID, entryID, "", "Delete entry "+entryID)
+}
+
+// URL is empty, pages only exist inside the repository.
+func (sink *Git) URL(pageID string) string {
+	return ""
+}
+
+// replace swaps the marked block of entryID for value and commits the file.
+func (sink *Git) replace(ctx context.Context, pageID, entryID, value, message string) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	content, err := sink.read(pageID)
+	if err != nil {
+		return err
+	}
+
+	start := findLine(content, startMarker(entryID), 0)
+	if start < 0 {
+		return errors.New("cannot find entry " + entryID)
+	}
+
+	end := findLine(content, endMarker, start)
+	if end < 0 {
+		return errors.New("unterminated entry " + entryID)
+	}
+	end += len(endMarker) + 1
+
+	if end > len(content) {
+		end = len(content)
+	}
+
+	if err := sink.write(pageID, content[:start]+value+content[end:]); err != nil {
+		return err
+	}
+
+	return sink.commit(ctx, pageID, message)
+}
+
+func (sink *Git) read(pageID string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sink.Dir, pageID))
+	return string(data), err
+}
+
+func (sink *Git) exists(pageID string) bool {
+	_, err := os.Stat(filepath.Join(sink.Dir, pageID))
+	return !os.IsNotExist(err)
+}
+
+func (sink *Git) write(pageID, content string) error {
+	return ioutil.WriteFile(filepath.Join(sink.Dir, pageID), []byte(content), 0644)
+}
+
+func (sink *Git) commit(ctx context.Context, pageID, message string) error {
+	if err := sink.git(ctx, "add", "--", pageID); err != nil {
+		return err
+	}
+	logger.FromContext(ctx).Debug("git commit", "page", pageID, "message", message)
+	return sink.git(ctx, "commit", "-q", "-m", message, "--", pageID)
+}
+
+func (sink *Git) git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", sink.Dir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New("git " + args[0] + ": " + err.Error() + ": " + string(out))
+	}
+	return nil
+}
+
+const endMarker = "<!-- /entry -->"
+
+func startMarker(entryID string) string {
+	return "<!-- entry " + entryID + " -->"
+}
+
+// findLine returns the offset of the first line from offset on that is
+// exactly line, or -1.
+func findLine(content, line string, offset int) int {
+	for offset <= len(content) {
+		i := strings.Index(content[offset:], line)
+		if i < 0 {
+			return -1
+		}
+		i += offset
+
+		startsLine := i == 0 || content[i-1] == '\n'
+		rest := content[i+len(line):]
+		if startsLine && (rest == "" || rest[0] == '\n') {
+			return i
+		}
+		offset = i + 1
+	}
+	return -1
+}
+
+// wrapEntry marks an entry so replace can find it again. Comments are
+// escaped inside the entry so message text can't fake a marker.
+func wrapEntry(entryID string, entry Entry) string {
+	escape := strings.NewReplacer("<!--", "&lt;!--").Replace
+	return startMarker(entryID) + "\n" +
+		markdown.Entry(escape(entry.Header()), escape(entry.Text), LinkText, escape(entry.Permalink)) +
+		endMarker + "\n"
+}
+
+func newEntryID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
@@ -0,0 +1,161 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"backlink/markdown"
+	"backlink/notion"
+)
+
+// Notion writes backlinks as child pages of the session's first root page.
+type Notion struct {
+	Session *notion.Session
+}
+
+func NewNotion(session *notion.Session) *Notion {
+	return &Notion{Session: session}
+}
+
+func (sink *Notion) CreatePage(ctx context.Context, root string, title string, entry Entry) (string, string, error) {
+	blocks := entryBlocks(entry)
+
+	var pageID string
+	if root != "" {
+		page, err := sink.client(ctx).CreatePageWithBlocks(root, title, blocks)
+		if err != nil {
+			return "", "", err
+		}
+		pageID = *page.Id
+	} else {
+		if len(sink.Session.Pages) == 0 {
+			return "", "", errors.New("no root page")
+		}
+
+		parent := sink.Session.Pages[0]
+		parent.Client = sink.client(ctx)
+		page, err := parent.AppendPageWithBlocks(title, blocks)
+		if err != nil {
+			return "", "", err
+		}
+		pageID = page.Id
+	}
+
+	entryID, err := sink.firstBlocks(ctx, pageID, len(blocks))
+	return pageID, entryID, err
+}
+
+func (sink *Notion) AppendEntry(ctx context.Context, pageID string, entry Entry) (string, error) {
+	blocks := entryBlocks(entry)
+	created, err := sink.client(ctx).AppendChildren(pageID, blocks)
+	if err != nil {
+		return "", err
+	}
+	if len(created) != len(blocks) {
+		return "", errors.New("missing appended blocks")
+	}
+
+	return blockIDs(created), nil
+}
+
+func (sink *Notion) UpdateEntry(ctx context.Context, pageID string, entryID string, entry Entry) error {
+	ids := strings.Split(entryID, ",")
+	blocks := entryBlocks(entry)
+	if len(ids) != len(blocks) {
+		return errors.New("entry does not match block layout")
+	}
+
+	for i, id := range ids {
+		if _, err := sink.client(ctx).UpdateBlock(id, blocks[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sink *Notion) DeleteEntry(ctx context.Context, pageID string, entryID string) error {
+	for _, id := range strings.Split(entryID, ",") {
+		if err := sink.client(ctx).DeleteBlock(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// client makes requests with the event's ctx.
+func (sink *Notion) client(ctx context.Context) notion.Client {
+	return sink.Session.Client.WithContext(ctx)
+}
+
+func (sink *Notion) URL(pageID string) string {
+	return markdown.NotionURL(pageID)
+}
+
+// firstBlocks returns the ids of the first n blocks of a page, creating a
+// page doesn't give back the ids of its blocks.
+func (sink *Notion) firstBlocks(ctx context.Context, pageID string, n int) (string, error) {
+	blocks, err := sink.client(ctx).GetChildren(pageID, notion.Limit(n)).All()
+	if err != nil {
+		return "", err
+	}
+
+	if len(blocks) < n {
+		return "", errors.New("missing appended blocks")
+	}
+
+	return blockIDs(blocks), nil
+}
+
+// blockIDs joins the ids of blocks with commas, which is how an entry id is
+// represented for notion.
+func blockIDs(blocks []notion.Block) string {
+	var ids []string
+	for _, block := range blocks {
+		ids = append(ids, *block.Id)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func text(content string, link *notion.Link) []notion.RichText {
+	return []notion.RichText{
+		{
+			Type: "text",
+			Text: &notion.TextInfo{
+				Content: content,
+				Link:    link,
+			},
+		},
+	}
+}
+
+// entryBlocks lays an entry out as a heading with the author and time, the
+// message text and a link back to slack. The link paragraph is left empty
+// when there is no permalink so entries always have the same three blocks.
+func entryBlocks(entry Entry) []notion.Block {
+	link := []notion.RichText{}
+	if entry.Permalink != "" {
+		link = text(LinkText, &notion.Link{URL: entry.Permalink})
+	}
+
+	return []notion.Block{
+		{
+			Object:   "block",
+			Type:     "heading_3",
+			Heading3: &notion.Text{Text: text(entry.Header(), nil)},
+		},
+		{
+			Object:    "block",
+			Type:      "paragraph",
+			Paragraph: &notion.TextTree{Text: text(entry.Text, nil)},
+		},
+		{
+			Object:    "block",
+			Type:      "paragraph",
+			Paragraph: &notion.TextTree{Text: link},
+		},
+	}
+}
@@ -0,0 +1,42 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Formatting of entries, set from the config at startup.
+var (
+	TimeLayout = time.RFC822
+	Location   = time.UTC
+	LinkText   = "Go To Message"
+)
+
+// Entry is a single slack message captured under a backlink.
+type Entry struct {
+	Author    string
+	Time      time.Time
+	Text      string
+	Permalink string
+}
+
+// Header is the line shown above the message text, e.g. "Jane Doe 02 Jan 06 15:04 UTC".
+func (entry Entry) Header() string {
+	return fmt.Sprint(entry.Author, " ", entry.Time.In(Location).Format(TimeLayout))
+}
+
+// Sink is where captured messages are written. Page ids are stored in the db
+// next to the backlink name, entry ids are only meaningful to the sink that
+// returned them. ctx carries the logger of the event being handled.
+type Sink interface {
+	// CreatePage creates the page for a new backlink with entry as its first
+	// message. root picks where the page goes, empty means the sink's default.
+	CreatePage(ctx context.Context, root string, title string, entry Entry) (pageID string, entryID string, err error)
+	AppendEntry(ctx context.Context, pageID string, entry Entry) (string, error)
+	UpdateEntry(ctx context.Context, pageID string, entryID string, entry Entry) error
+	DeleteEntry(ctx context.Context, pageID string, entryID string) error
+	// URL links to a page for people, empty if it can't be opened in a
+	// browser.
+	URL(pageID string) string
+}
@@ -0,0 +1,285 @@
+package slack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backlink/db"
+	"backlink/logger"
+	"backlink/metrics"
+
+	"github.com/slack-go/slack"
+)
+
+// backfillPause spaces out history requests to stay well inside slack's tier 3
+// limit of about 50 calls a minute.
+const backfillPause = 1200 * time.Millisecond
+
+var backfills sync.Map
+
+// backfill handles `/backlink backfill [#channel] [from YYYY-MM-DD] [to YYYY-MM-DD]`.
+// It runs in the background and reports back when it is done. Running it
+// again with the same range resumes from the last message written.
+func (bot *Bot) backfill(ctx context.Context, cmd slack.SlashCommand, team *Team, args []string) {
+	if !isAdmin(ctx, team, cmd.UserID) {
+		reply(ctx, team, cmd, "Only workspace admins can backfill channels.")
+		return
+	}
+
+	channel := cmd.ChannelID
+	args = args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "<#") {
+		channel = strings.SplitN(strings.Trim(args[0], "<#>"), "|", 2)[0]
+		args = args[1:]
+	}
+
+	var oldest, latest string
+	for i := 0; i+1 < len(args); i += 2 {
+		day, err := time.Parse("2006-01-02", args[i+1])
+		if err != nil {
+			reply(ctx, team, cmd, "Dates look like 2021-07-31.")
+			return
+		}
+		switch args[i] {
+		case "from":
+			oldest = strconv.FormatInt(day.Unix(), 10) + ".000000"
+		case "to":
+			latest = strconv.FormatInt(day.AddDate(0, 0, 1).Unix(), 10) + ".000000"
+		default:
+			reply(ctx, team, cmd, usage)
+			return
+		}
+	}
+
+	if !bot.allowed(channel) {
+		reply(ctx, team, cmd, "<#"+channel+"> is excluded by the bot's channel config.")
+		return
+	}
+
+	key := team.ID + "/" + channel
+	if _, running := backfills.LoadOrStore(key, true); running {
+		reply(ctx, team, cmd, "<#"+channel+"> is already being backfilled.")
+		return
+	}
+
+	reply(ctx, team, cmd, "Backfilling <#"+channel+">, I'll let you know when it's done.")
+
+	go func() {
+		defer backfills.Delete(key)
+
+		written, err := bot.runBackfill(ctx, team, channel, oldest, latest)
+		if err != nil {
+			logger.FromContext(ctx).Error("backfill stopped", "channel", channel, "written", written, "err", err)
+			reply(ctx, team, cmd, fmt.Sprintf("Backfilling <#%s> stopped after %d messages: %v. Run the same command to resume.",
+				channel, written, err))
+			return
+		}
+		reply(ctx, team, cmd, fmt.Sprintf("Backfilled <#%s>, %d messages were added to backlinks.", channel, written))
+	}()
+}
+
+// runBackfill captures every message with backlinks in the range, oldest
+// first, saving a checkpoint after each one.
+func (bot *Bot) runBackfill(ctx context.Context, team *Team, channel, oldest, latest string) (int, error) {
+	if !bot.allowed(channel) {
+		return 0, errors.New("the channel is excluded by the channel config")
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		return 0, err
+	}
+	channelType, err := conversationType(ctx, team, channel)
+	if err != nil {
+		return 0, err
+	}
+	root, ok := channelRoute(ctx, team, workspace, channel, channelType)
+	if !ok {
+		return 0, errors.New("the channel is excluded by the channel rules")
+	}
+
+	checkpoint, err := db.GetBackfill(ctx, workspace.ID, channel, oldest, latest)
+	if err != nil {
+		return 0, err
+	}
+
+	msgs, err := backlinkHistory(ctx, team.API, channel, oldest, latest)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, msg := range msgs {
+		if checkpoint.LastTS != "" && !tsAfter(msg.trigger, checkpoint.LastTS) {
+			continue
+		}
+
+		results := bot.capture(ctx, team, workspace, root, msg.message, msg.backlinks)
+		for _, result := range results {
+			if result.Err != nil {
+				return written, result.Err
+			}
+		}
+		written++
+
+		mention := db.Occurrence{WorkspaceID: workspace.ID, ChannelID: channel, UserID: msg.author, TS: msg.trigger}
+		if msg.trigger != msg.TS {
+			mention.ThreadTS = msg.TS
+		}
+		recordOccurrences(ctx, team, mention, results)
+
+		if err := db.SaveBackfillProgress(ctx, checkpoint.ID, msg.trigger); err != nil {
+			return written, err
+		}
+
+		// each capture makes a couple of slack calls and several to notion
+		time.Sleep(backfillPause)
+	}
+
+	return written, db.FinishBackfill(ctx, checkpoint.ID)
+}
+
+// historic is a message found while backfilling. trigger is the timestamp of
+// the message containing the [[links]] and who wrote it, which for
+// thread replies is not the message that gets captured.
+type historic struct {
+	message
+	backlinks []string
+	trigger   string
+	author    string
+}
+
+// backlinkHistory pages through a channel and its threads and returns the
+// messages mentioning backlinks in chronological order.
+func backlinkHistory(ctx context.Context, api *slack.Client, channel, oldest, latest string) ([]historic, error) {
+	var found []historic
+	cursor := ""
+
+	for {
+		var history *slack.GetConversationHistoryResponse
+		err := rateLimited(ctx, func() (err error) {
+			history, err = api.GetConversationHistory(&slack.GetConversationHistoryParameters{
+				ChannelID: channel,
+				Oldest:    oldest,
+				Latest:    latest,
+				Cursor:    cursor,
+				Limit:     200,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range history.Messages {
+			parent := message{Channel: channel, TS: msg.Timestamp, UserID: msg.User, Text: msg.Text, Once: true}
+
+			if backlinks := getBacklinks(msg.Text); len(backlinks) > 0 {
+				found = append(found, historic{message: parent, backlinks: backlinks, trigger: msg.Timestamp, author: msg.User})
+			}
+
+			if msg.ReplyCount == 0 {
+				continue
+			}
+
+			replies, err := threadReplies(ctx, api, channel, msg.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			for _, reply := range replies {
+				if reply.Timestamp == msg.Timestamp {
+					continue
+				}
+				// like live messages, a reply adds its thread's parent
+				if backlinks := getBacklinks(reply.Text); len(backlinks) > 0 {
+					found = append(found, historic{message: parent, backlinks: backlinks, trigger: reply.Timestamp, author: reply.User})
+				}
+			}
+		}
+
+		if !history.HasMore || history.ResponseMetaData.NextCursor == "" {
+			break
+		}
+		cursor = history.ResponseMetaData.NextCursor
+		time.Sleep(backfillPause)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return tsAfter(found[j].trigger, found[i].trigger)
+	})
+
+	return found, nil
+}
+
+func threadReplies(ctx context.Context, api *slack.Client, channel, ts string) ([]slack.Message, error) {
+	var all []slack.Message
+	cursor := ""
+
+	for {
+		var msgs []slack.Message
+		var hasMore bool
+		var next string
+		err := rateLimited(ctx, func() error {
+			return traced(ctx, "conversations.replies", func(ctx context.Context) (err error) {
+				msgs, hasMore, next, err = api.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+					ChannelID: channel,
+					Timestamp: ts,
+					Cursor:    cursor,
+					Limit:     200,
+				})
+				return err
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, msgs...)
+
+		if !hasMore || next == "" {
+			return all, nil
+		}
+		cursor = next
+		time.Sleep(backfillPause)
+	}
+}
+
+// rateLimited retries call for as long as slack asks us to wait.
+func rateLimited(ctx context.Context, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := call()
+
+		var limited *slack.RateLimitedError
+		if errors.As(err, &limited) && attempt < 5 {
+			logger.FromContext(ctx).Info("slack rate limited", "wait", limited.RetryAfter)
+			metrics.Retries.WithLabelValues("slack").Inc()
+			metrics.RateLimitWait.WithLabelValues("slack").Add(limited.RetryAfter.Seconds())
+			time.Sleep(limited.RetryAfter)
+			continue
+		}
+		return err
+	}
+}
+
+// tsAfter compares two slack timestamps. They are parsed in two halves since
+// a float64 can't hold the microseconds exactly.
+func tsAfter(a, b string) bool {
+	split := func(ts string) (int64, int64) {
+		parts := strings.SplitN(ts, ".", 2)
+		seconds, _ := strconv.ParseInt(parts[0], 10, 64)
+		var micros int64
+		if len(parts) == 2 {
+			micros, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		return seconds, micros
+	}
+
+	as, am := split(a)
+	bs, bm := split(b)
+	return as > bs || (as == bs && am > bm)
+}
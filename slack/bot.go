@@ -0,0 +1,47 @@
+package slack
+
+import (
+	"backlink/config"
+	"backlink/redact"
+)
+
+// Bot holds what event handlers need besides the team an event came from.
+type Bot struct {
+	Teams *Teams
+
+	// Notion is nil when the notion public integration isn't configured.
+	Notion *NotionOAuth
+
+	Channels config.Channels
+
+	// Redactor scrubs message text before it is written, nil writes it
+	// as is.
+	Redactor *redact.Redactor
+
+	Reactions config.Reactions
+
+	Digest config.Digest
+
+	// Confirmations is one of ConfirmOff, ConfirmEphemeral or ConfirmThread.
+	Confirmations string
+}
+
+// allowed reports whether messages in channel should be captured.
+func (bot *Bot) allowed(channel string) bool {
+	for _, id := range bot.Channels.Deny {
+		if id == channel {
+			return false
+		}
+	}
+
+	if len(bot.Channels.Allow) == 0 {
+		return true
+	}
+
+	for _, id := range bot.Channels.Allow {
+		if id == channel {
+			return true
+		}
+	}
+	return false
+}
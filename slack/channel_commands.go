@@ -0,0 +1,130 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+)
+
+var settings = map[string]string{
+	"optin":   "require_opt_in",
+	"private": "ignore_private",
+	"dms":     "ignore_dms",
+}
+
+// channelCommand handles the /backlink commands that manage channel rules.
+// Anyone can enable or disable the channel they are in, the rest is limited
+// to admins.
+func (bot *Bot) channelCommand(ctx context.Context, cmd slack.SlashCommand, team *Team, args []string) {
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("workspace not found", "err", err)
+		reply(ctx, team, cmd, "This workspace isn't set up yet.")
+		return
+	}
+
+	switch args[0] {
+	case "enable", "disable":
+		action := db.RuleAllow
+		if args[0] == "disable" {
+			action = db.RuleDeny
+		}
+		if err := db.SetChannelRule(ctx, workspace.ID, cmd.ChannelID, action); err != nil {
+			logger.FromContext(ctx).Error("saving channel rule failed", "err", err)
+			reply(ctx, team, cmd, "Could not save the rule.")
+			return
+		}
+		reply(ctx, team, cmd, "Backlinks are now "+args[0]+"d in <#"+cmd.ChannelID+">.")
+		return
+	case "rules":
+		reply(ctx, team, cmd, describeRules(ctx, workspace))
+		return
+	}
+
+	if !isAdmin(ctx, team, cmd.UserID) {
+		reply(ctx, team, cmd, "Only workspace admins can change channel rules.")
+		return
+	}
+
+	switch {
+	case (args[0] == "allow" || args[0] == "ignore") && len(args) == 2:
+		action := db.RuleAllow
+		if args[0] == "ignore" {
+			action = db.RuleDeny
+		}
+		err = db.AddChannelRule(ctx, db.ChannelRule{WorkspaceID: workspace.ID, Pattern: strings.TrimPrefix(args[1], "#"), Action: action})
+	case args[0] == "route" && len(args) == 3:
+		err = db.AddChannelRule(ctx, db.ChannelRule{
+			WorkspaceID: workspace.ID,
+			Pattern:     strings.TrimPrefix(args[1], "#"),
+			Action:      db.RuleRoute,
+			RootPage:    args[2],
+		})
+	case args[0] == "unrule" && len(args) == 2:
+		var id uint64
+		id, err = strconv.ParseUint(args[1], 10, 32)
+		if err == nil {
+			err = db.DeleteChannelRule(ctx, workspace.ID, uint(id))
+		}
+	case args[0] == "set" && len(args) == 3 && settings[args[1]] != "":
+		err = db.SetWorkspaceSetting(ctx, workspace.ID, settings[args[1]], args[2] == "on")
+	default:
+		reply(ctx, team, cmd, usage)
+		return
+	}
+
+	if err != nil {
+		logger.FromContext(ctx).Error("saving channel rule failed", "err", err)
+		reply(ctx, team, cmd, "Could not update the rules: "+err.Error())
+		return
+	}
+
+	workspace, err = db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		reply(ctx, team, cmd, "Saved.")
+		return
+	}
+	reply(ctx, team, cmd, "Saved.\n"+describeRules(ctx, workspace))
+}
+
+func describeRules(ctx context.Context, workspace db.Workspace) string {
+	rules, err := db.GetChannelRules(ctx, workspace.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("loading channel rules failed", "err", err)
+		return "Could not load the rules."
+	}
+
+	onOff := func(on bool) string {
+		if on {
+			return "on"
+		}
+		return "off"
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "opt-in required: %s, private channels ignored: %s, DMs ignored: %s\n",
+		onOff(workspace.RequireOptIn), onOff(workspace.IgnorePrivate), onOff(workspace.IgnoreDMs))
+
+	if len(rules) == 0 {
+		builder.WriteString("No channel rules.")
+	}
+	for _, rule := range rules {
+		target := "`" + rule.Pattern + "`"
+		if rule.ChannelID != "" {
+			target = "<#" + rule.ChannelID + ">"
+		}
+		fmt.Fprintf(&builder, "%d. %s %s", rule.ID, rule.Action, target)
+		if rule.Action == db.RuleRoute {
+			builder.WriteString(" to " + rule.RootPage)
+		}
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
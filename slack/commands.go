@@ -0,0 +1,202 @@
+package slack
+
+import (
+	"context"
+	"strings"
+
+	"backlink/db"
+	"backlink/logger"
+	"backlink/notion"
+
+	"github.com/slack-go/slack"
+)
+
+const rootPageCallback = "backlink_root_page"
+
+const usage = "Usage:\n" +
+	"`/backlink notion` connect a notion workspace\n" +
+	"`/backlink setup` pick the notion page backlinks are created under\n" +
+	"`/backlink enable` / `/backlink disable` capture this channel or not\n" +
+	"`/backlink allow <pattern>` / `/backlink ignore <pattern>` capture channels whose name matches, e.g. `eng-*`\n" +
+	"`/backlink route <pattern> <page id>` create new pages for matching channels under another page\n" +
+	"`/backlink unrule <id>` remove a rule\n" +
+	"`/backlink rules` list the channel rules\n" +
+	"`/backlink set <optin|private|dms> <on|off>` require opt-in, ignore private channels or DMs\n" +
+	"`/backlink optout [off]` stop (or resume) capturing your messages\n" +
+	"`/backlink forget-me [anonymize]` delete or anonymize everything captured from your messages\n" +
+	"`/backlink backfill [#channel] [from YYYY-MM-DD] [to YYYY-MM-DD]` add backlinks from older messages\n" +
+	"`/backlink digest <daily|weekly|off>` post a digest of backlink activity to this channel\n" +
+	"`/backlink stats <backlink>` who mentions a backlink, where and how often"
+
+// HandleCommand runs a /backlink slash command.
+func (bot *Bot) HandleCommand(ctx context.Context, cmd slack.SlashCommand, team *Team) {
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 {
+		reply(ctx, team, cmd, usage)
+		return
+	}
+
+	switch args[0] {
+	case "notion":
+		bot.connectNotion(ctx, cmd, team)
+	case "setup":
+		bot.pickRootPage(ctx, cmd, team)
+	case "optout":
+		bot.optOut(ctx, cmd, team, args)
+	case "forget-me":
+		bot.forgetMe(ctx, cmd, team, args)
+	case "backfill":
+		bot.backfill(ctx, cmd, team, args)
+	case "digest":
+		bot.digest(ctx, cmd, team, args)
+	case "stats":
+		bot.stats(ctx, cmd, team, args)
+	case "enable", "disable", "allow", "ignore", "route", "unrule", "rules", "set":
+		bot.channelCommand(ctx, cmd, team, args)
+	default:
+		reply(ctx, team, cmd, usage)
+	}
+}
+
+// HandleInteraction handles modal submissions and button presses.
+func (bot *Bot) HandleInteraction(ctx context.Context, callback slack.InteractionCallback, team *Team) {
+	switch callback.Type {
+	case slack.InteractionTypeViewSubmission:
+		switch callback.View.CallbackID {
+		case rootPageCallback:
+			bot.saveRootPage(ctx, callback, team)
+		case reactionPromptCallback:
+			bot.submitBacklinkModal(ctx, callback, team)
+		}
+	case slack.InteractionTypeBlockActions:
+		for _, action := range callback.ActionCallback.BlockActions {
+			switch action.ActionID {
+			case reactionPromptAction:
+				bot.openBacklinkModal(ctx, callback, action, team)
+			case retryAction:
+				bot.retryCapture(ctx, callback, action, team)
+			}
+		}
+	}
+}
+
+func (bot *Bot) connectNotion(ctx context.Context, cmd slack.SlashCommand, team *Team) {
+	if bot.Notion == nil {
+		reply(ctx, team, cmd, "Connecting notion isn't enabled for this bot.")
+		return
+	}
+	if !isAdmin(ctx, team, cmd.UserID) {
+		reply(ctx, team, cmd, "Only workspace admins can connect notion.")
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("workspace not found", "err", err)
+		reply(ctx, team, cmd, "This workspace isn't set up yet.")
+		return
+	}
+
+	link, err := bot.Notion.AuthorizeURL(workspace.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("notion link failed", "err", err)
+		reply(ctx, team, cmd, "Something went wrong, try again.")
+		return
+	}
+
+	reply(ctx, team, cmd, "<"+link+"|Connect a notion workspace> (link expires in 10 minutes)")
+}
+
+func (bot *Bot) pickRootPage(ctx context.Context, cmd slack.SlashCommand, team *Team) {
+	if !isAdmin(ctx, team, cmd.UserID) {
+		reply(ctx, team, cmd, "Only workspace admins can change the root page.")
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil || workspace.NotionToken == "" {
+		reply(ctx, team, cmd, "Connect notion first with `/backlink notion`.")
+		return
+	}
+
+	pages, err := notion.NewClient(workspace.NotionToken).WithContext(ctx).SearchPages("", notion.Limit(100)).All()
+	if err != nil {
+		logger.FromContext(ctx).Error("searching pages failed", "err", err)
+		reply(ctx, team, cmd, "Could not list notion pages.")
+		return
+	}
+
+	var options []*slack.OptionBlockObject
+	for _, page := range pages {
+		title := "Untitled"
+		if page.Properties != nil {
+			if t := notion.Flatten(page.Properties.Title.Title); t != "" {
+				title = t
+			}
+		}
+		// slack allows 75 characters, cut on runes so the text stays utf-8
+		if runes := []rune(title); len(runes) > 75 {
+			title = string(runes[:72]) + "..."
+		}
+
+		options = append(options, slack.NewOptionBlockObject(*page.Id, slack.NewTextBlockObject(slack.PlainTextType, title, false, false), nil))
+	}
+
+	if len(options) == 0 {
+		reply(ctx, team, cmd, "The integration can't see any pages yet, share a page with it in notion.")
+		return
+	}
+
+	selectPage := slack.NewOptionsSelectBlockElement(slack.OptTypeStatic,
+		slack.NewTextBlockObject(slack.PlainTextType, "Choose a page", false, false), "page", options...)
+
+	view := slack.ModalViewRequest{
+		Type:       slack.VTModal,
+		CallbackID: rootPageCallback,
+		Title:      slack.NewTextBlockObject(slack.PlainTextType, "Backlink root page", false, false),
+		Submit:     slack.NewTextBlockObject(slack.PlainTextType, "Save", false, false),
+		Close:      slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks: slack.Blocks{BlockSet: []slack.Block{
+			slack.NewInputBlock("root_page", slack.NewTextBlockObject(slack.PlainTextType, "New backlink pages go under", false, false), selectPage),
+		}},
+	}
+
+	if _, err := team.API.OpenView(cmd.TriggerID, view); err != nil {
+		logger.FromContext(ctx).Error("opening view failed", "err", err)
+	}
+}
+
+func (bot *Bot) saveRootPage(ctx context.Context, callback slack.InteractionCallback, team *Team) {
+	page := callback.View.State.Values["root_page"]["page"].SelectedOption.Value
+	if page == "" {
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("workspace not found", "err", err)
+		return
+	}
+	if err := db.SetRootPages(ctx, workspace.ID, page); err != nil {
+		logger.FromContext(ctx).Error("saving root page failed", "err", err)
+		return
+	}
+
+	bot.Teams.Forget(workspace.EnterpriseID, workspace.TeamID)
+}
+
+func reply(ctx context.Context, team *Team, cmd slack.SlashCommand, text string) {
+	_, err := team.API.PostEphemeral(cmd.ChannelID, cmd.UserID, slack.MsgOptionText(text, false))
+	if err != nil {
+		logger.FromContext(ctx).Error("reply failed", "err", err)
+	}
+}
+
+func isAdmin(ctx context.Context, team *Team, userID string) bool {
+	user, err := team.User(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("user info failed", "err", err)
+		return false
+	}
+	return user.IsAdmin || user.IsOwner
+}
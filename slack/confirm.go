@@ -0,0 +1,151 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	ConfirmOff       = "off"
+	ConfirmEphemeral = "ephemeral"
+	ConfirmThread    = "thread"
+)
+
+const retryAction = "backlink_retry"
+
+// retry is what the retry button carries to capture the failed backlinks
+// again.
+type retry struct {
+	Channel     string   `json:"c"`
+	TS          string   `json:"ts"`
+	Backlinks   []string `json:"b"`
+	Reaction    string   `json:"r,omitempty"`
+	ReactorID   string   `json:"u,omitempty"`
+	TriggerUser string   `json:"tu"`
+	TriggerTS   string   `json:"tt"`
+	InThread    bool     `json:"th,omitempty"`
+}
+
+// confirm tells whoever triggered a capture where the message went, either
+// privately or as a thread reply depending on Bot.Confirmations.
+func (bot *Bot) confirm(ctx context.Context, team *Team, msg message, results []captured) {
+	if len(results) == 0 || bot.Confirmations == ConfirmOff || msg.TriggerUser == "" {
+		return
+	}
+
+	var lines []string
+	var failed []string
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.Backlink)
+			continue
+		}
+
+		name := result.Backlink
+		if url := team.Sink.URL(result.PageID); url != "" {
+			name = "<" + url + "|" + result.Backlink + ">"
+		}
+		if result.Created {
+			name += " (new page)"
+		}
+		lines = append(lines, "• "+name)
+	}
+
+	var blocks []slack.Block
+	text := ""
+	if len(lines) > 0 {
+		text = "Added to:\n" + strings.Join(lines, "\n")
+	}
+	if len(failed) > 0 {
+		if text != "" {
+			text += "\n"
+		}
+		text += "Could not add to: " + strings.Join(failed, ", ")
+	}
+	blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil))
+
+	if len(failed) > 0 {
+		value, err := json.Marshal(retry{
+			Channel:     msg.Channel,
+			TS:          msg.TS,
+			Backlinks:   failed,
+			Reaction:    msg.Reaction,
+			ReactorID:   msg.ReactorID,
+			TriggerUser: msg.TriggerUser,
+			TriggerTS:   msg.TriggerTS,
+			InThread:    msg.TriggerInThread,
+		})
+		if err == nil && len(value) <= 2000 {
+			button := slack.NewButtonBlockElement(retryAction, string(value),
+				slack.NewTextBlockObject(slack.PlainTextType, "Retry", false, false))
+			blocks = append(blocks, slack.NewActionBlock("", button))
+		}
+	}
+
+	options := []slack.MsgOption{
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionBlocks(blocks...),
+	}
+
+	var err error
+	if bot.Confirmations == ConfirmThread {
+		options = append(options, slack.MsgOptionTS(msg.TriggerTS))
+		_, _, err = team.API.PostMessage(msg.Channel, options...)
+	} else {
+		// only show up inside a thread when the capture was asked for there
+		if msg.TriggerInThread {
+			options = append(options, slack.MsgOptionTS(msg.TriggerTS))
+		}
+		_, err = team.API.PostEphemeral(msg.Channel, msg.TriggerUser, options...)
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("confirmation failed", "err", err)
+	}
+}
+
+// retryCapture handles the retry button from a confirmation.
+func (bot *Bot) retryCapture(ctx context.Context, callback slack.InteractionCallback, action *slack.BlockAction, team *Team) {
+	var r retry
+	if err := json.Unmarshal([]byte(action.Value), &r); err != nil {
+		logger.FromContext(ctx).Error("retry failed", "err", err)
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("retry failed", "err", err)
+		return
+	}
+	channelType, err := conversationType(ctx, team, r.Channel)
+	if err != nil {
+		logger.FromContext(ctx).Error("retry failed", "err", err)
+		return
+	}
+	root, ok := channelRoute(ctx, team, workspace, r.Channel, channelType)
+	if !ok {
+		return
+	}
+
+	msg, err := getMessage(ctx, team.API, r.Channel, r.TS)
+	if err != nil {
+		logger.FromContext(ctx).Error("retry failed", "err", err)
+		return
+	}
+	msg.Reaction = r.Reaction
+	msg.ReactorID = r.ReactorID
+	msg.TriggerUser = callback.User.ID
+	msg.TriggerTS = r.TriggerTS
+	msg.TriggerInThread = r.InThread
+	// a second press, or one after a partial success, must not add the
+	// message again
+	msg.Once = true
+
+	results := bot.capture(ctx, team, workspace, root, msg, r.Backlinks)
+	bot.confirm(ctx, team, msg, results)
+}
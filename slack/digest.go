@@ -0,0 +1,241 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+)
+
+// digest handles `/backlink digest <daily|weekly|off>`, subscribing the
+// channel it's run in.
+func (bot *Bot) digest(ctx context.Context, cmd slack.SlashCommand, team *Team, args []string) {
+	if len(args) != 2 {
+		reply(ctx, team, cmd, usage)
+		return
+	}
+
+	frequency := args[1]
+	switch frequency {
+	case db.DigestDaily, db.DigestWeekly:
+	case "off":
+		frequency = ""
+	default:
+		reply(ctx, team, cmd, usage)
+		return
+	}
+
+	if !isAdmin(ctx, team, cmd.UserID) {
+		reply(ctx, team, cmd, "Only workspace admins can set up digests.")
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		reply(ctx, team, cmd, "This workspace isn't set up yet.")
+		return
+	}
+
+	if err := db.SetDigest(ctx, workspace.ID, cmd.ChannelID, frequency); err != nil {
+		logger.FromContext(ctx).Error("saving digest failed", "err", err)
+		reply(ctx, team, cmd, "Could not save the digest, try again.")
+		return
+	}
+
+	if frequency == "" {
+		reply(ctx, team, cmd, "<#"+cmd.ChannelID+"> won't get digests anymore.")
+		return
+	}
+	reply(ctx, team, cmd, "<#"+cmd.ChannelID+"> will get a "+frequency+" digest of backlink activity.")
+}
+
+// PostDigests posts a digest of the period before at to every channel
+// subscribed at frequency.
+func (bot *Bot) PostDigests(frequency string, at time.Time) {
+	ctx := logger.NewContext(context.Background(),
+		logger.Default.With("correlation_id", logger.NewID(), "event", frequency+"_digest"))
+	digests, err := db.GetDigests(ctx, frequency)
+	if err != nil {
+		logger.FromContext(ctx).Error("loading digests failed", "err", err)
+		return
+	}
+
+	for _, digest := range digests {
+		log := logger.FromContext(ctx).With("workspace_id", digest.WorkspaceID, "channel", digest.ChannelID)
+		ctx := logger.NewContext(ctx, log)
+
+		workspace, err := db.GetWorkspace(ctx, digest.WorkspaceID)
+		if err != nil {
+			log.Error("digest workspace not found", "err", err)
+			continue
+		}
+
+		team, err := bot.Teams.Get(ctx, workspace.EnterpriseID, workspace.TeamID)
+		if err != nil {
+			log.Error("digest team not found", "err", err)
+			continue
+		}
+
+		text, err := bot.buildDigest(ctx, team, workspace, frequency, at)
+		if err != nil {
+			log.Error("building digest failed", "err", err)
+			continue
+		}
+		if text == "" {
+			// nothing happened, don't post an empty digest
+			continue
+		}
+
+		_, _, err = team.API.PostMessage(digest.ChannelID, slack.MsgOptionText(text, false), slack.MsgOptionDisableLinkUnfurl())
+		if err != nil {
+			log.Error("posting digest failed", "err", err)
+		}
+	}
+}
+
+// mentioned is a backlink with its mention counts this and last period.
+type mentioned struct {
+	db.Backlink
+	count    int
+	previous int
+}
+
+// buildDigest summarizes the period ending at: new pages, the most mentioned
+// ones, the ones mentioned more than the period before and the ones nobody
+// mentions anymore. It returns "" when nothing was mentioned or created.
+func (bot *Bot) buildDigest(ctx context.Context, team *Team, workspace db.Workspace, frequency string, at time.Time) (string, error) {
+	period := 24 * time.Hour
+	title := "today"
+	if frequency == db.DigestWeekly {
+		period = 7 * 24 * time.Hour
+		title = "this week"
+	}
+	from := at.Add(-period)
+	top := bot.Digest.Top
+
+	created, err := db.GetNewBacklinks(ctx, workspace.ID, from, at)
+	if err != nil {
+		return "", err
+	}
+	counts, err := db.CountMentions(ctx, workspace.ID, from, at)
+	if err != nil {
+		return "", err
+	}
+	if len(created) == 0 && len(counts) == 0 {
+		return "", nil
+	}
+	previous, err := db.CountMentions(ctx, workspace.ID, from.Add(-period), from)
+	if err != nil {
+		return "", err
+	}
+	orphaned, err := db.GetOrphanedBacklinks(ctx, workspace.ID, at.AddDate(0, 0, -bot.Digest.OrphanDays))
+	if err != nil {
+		return "", err
+	}
+
+	var ids []uint
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	backlinks, err := db.GetBacklinks(ctx, ids)
+	if err != nil {
+		return "", err
+	}
+
+	isNew := map[uint]bool{}
+	for _, backlink := range created {
+		isNew[backlink.ID] = true
+	}
+
+	var active, trending []mentioned
+	for _, backlink := range backlinks {
+		m := mentioned{Backlink: backlink, count: counts[backlink.ID], previous: previous[backlink.ID]}
+		active = append(active, m)
+		if m.count > m.previous && !isNew[backlink.ID] {
+			trending = append(trending, m)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		if active[i].count != active[j].count {
+			return active[i].count > active[j].count
+		}
+		return active[i].LinkName < active[j].LinkName
+	})
+	sort.SliceStable(trending, func(i, j int) bool {
+		gi, gj := trending[i].count-trending[i].previous, trending[j].count-trending[j].previous
+		if gi != gj {
+			return gi > gj
+		}
+		return trending[i].LinkName < trending[j].LinkName
+	})
+
+	var lines []string
+	lines = append(lines, "*Backlinks "+title+"*")
+
+	if len(created) > 0 {
+		var names []string
+		for _, backlink := range created {
+			names = append(names, pageLink(team, backlink))
+		}
+		lines = append(lines, "", "*New pages:* "+listNames(names, top))
+	}
+
+	if len(active) > 0 {
+		lines = append(lines, "", "*Most mentioned:*")
+		for i, m := range active {
+			if i == top {
+				break
+			}
+			lines = append(lines, fmt.Sprintf("%d. %s, %d %s", i+1, pageLink(team, m.Backlink), m.count, plural(m.count, "mention")))
+		}
+	}
+
+	if len(trending) > 0 {
+		lines = append(lines, "", "*Trending:*")
+		for i, m := range trending {
+			if i == top {
+				break
+			}
+			lines = append(lines, fmt.Sprintf("• %s, %d %s up from %d", pageLink(team, m.Backlink), m.count, plural(m.count, "mention"), m.previous))
+		}
+	}
+
+	if len(orphaned) > 0 {
+		var names []string
+		for _, backlink := range orphaned {
+			names = append(names, pageLink(team, backlink))
+		}
+		lines = append(lines, "", fmt.Sprintf("*Not mentioned in %d days:* %s", bot.Digest.OrphanDays, listNames(names, top)))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// pageLink links a backlink's page when the sink has urls.
+func pageLink(team *Team, backlink db.Backlink) string {
+	if url := team.Sink.URL(backlink.NotionID); url != "" {
+		return "<" + url + "|" + backlink.LinkName + ">"
+	}
+	return backlink.LinkName
+}
+
+// listNames joins the first max names and says how many were left out.
+func listNames(names []string, max int) string {
+	if len(names) <= max {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:max], ", "), len(names)-max)
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
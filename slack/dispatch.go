@@ -0,0 +1,116 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+
+	"backlink/logger"
+	"backlink/metrics"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// The Dispatch functions are shared by socket mode and the http server, they
+// are called after the payload has been acknowledged. Callers increment
+// metrics.QueueDepth when acknowledging and the Dispatch functions decrement
+// it once handled.
+
+// eventContext starts the context everything handling one payload runs with,
+// its logger tags every line with a new correlation id.
+func eventContext(enterpriseID, teamID string, eventType string) context.Context {
+	log := logger.Default.With("correlation_id", logger.NewID(), "enterprise_id", enterpriseID,
+		"team_id", teamID, "event", eventType)
+	return logger.NewContext(context.Background(), log)
+}
+
+// EnterpriseID reads the Enterprise Grid org out of a raw event or
+// interaction payload, slack-go doesn't parse it. Events carry it as
+// enterprise_id and interactions as enterprise.id, it is empty outside Grid.
+func EnterpriseID(payload []byte) string {
+	var envelope struct {
+		EnterpriseID string `json:"enterprise_id"`
+		Enterprise   *struct {
+			ID string `json:"id"`
+		} `json:"enterprise"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return ""
+	}
+	if envelope.EnterpriseID == "" && envelope.Enterprise != nil {
+		return envelope.Enterprise.ID
+	}
+	return envelope.EnterpriseID
+}
+
+func (bot *Bot) DispatchEvent(event slackevents.EventsAPIEvent, enterpriseID string) {
+	defer metrics.QueueDepth.Dec()
+	eventType := event.InnerEvent.Type
+	if eventType == "" {
+		eventType = event.Type
+	}
+	metrics.SlackEvents.WithLabelValues(eventType).Inc()
+
+	ctx := eventContext(enterpriseID, event.TeamID, eventType)
+	log := logger.FromContext(ctx)
+
+	if event.Type != slackevents.CallbackEvent {
+		log.Warn("unsupported events API event")
+		return
+	}
+
+	team, err := bot.Teams.Get(ctx, enterpriseID, event.TeamID)
+	if err != nil {
+		log.Error("team not found", "err", err)
+		return
+	}
+
+	switch ev := event.InnerEvent.Data.(type) {
+	case *slackevents.AppMentionEvent:
+		log.Info("bot mentioned", "channel", ev.Channel)
+		_, _, err := team.API.PostMessage(ev.Channel, slack.MsgOptionText("Yes, hello.", false))
+		if err != nil {
+			log.Error("post message failed", "err", err)
+		}
+	case *slackevents.MessageEvent:
+		log.Debug("message received", "channel", ev.Channel, "ts", ev.TimeStamp)
+		if !bot.allowed(ev.Channel) {
+			return
+		}
+		bot.HandleMsgs(ctx, ev, team)
+	case *slackevents.ReactionAddedEvent:
+		bot.HandleReactionAdded(ctx, ev, team)
+	case *slackevents.ReactionRemovedEvent:
+		bot.HandleReactionRemoved(ctx, ev, team)
+	case *slack.UserChangeEvent, *slack.TeamRenameEvent, *slack.ChannelRenameEvent:
+		team.metadataChanged(ctx, ev)
+	}
+}
+
+func (bot *Bot) DispatchCommand(cmd slack.SlashCommand) {
+	defer metrics.QueueDepth.Dec()
+	metrics.SlackEvents.WithLabelValues("slash_command").Inc()
+
+	ctx := eventContext(cmd.EnterpriseID, cmd.TeamID, "slash_command")
+	team, err := bot.Teams.Get(ctx, cmd.EnterpriseID, cmd.TeamID)
+	if err != nil {
+		logger.FromContext(ctx).Error("team not found", "err", err)
+		return
+	}
+
+	bot.HandleCommand(ctx, cmd, team)
+}
+
+func (bot *Bot) DispatchInteraction(callback slack.InteractionCallback, enterpriseID string) {
+	defer metrics.QueueDepth.Dec()
+	metrics.SlackEvents.WithLabelValues(string(callback.Type)).Inc()
+
+	ctx := eventContext(enterpriseID, callback.Team.ID, string(callback.Type))
+	team, err := bot.Teams.Get(ctx, enterpriseID, callback.Team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("team not found", "err", err)
+		return
+	}
+
+	bot.HandleInteraction(ctx, callback, team)
+}
@@ -0,0 +1,141 @@
+package slack
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"backlink/cache"
+	"backlink/logger"
+	"backlink/metrics"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// seenEvents are the ids of recently received events, slack retries for up
+// to an hour.
+var seenEvents = cache.New("slack_event", 10000, time.Hour)
+
+// maxBody caps how much of a request is read before verifying its signature.
+const maxBody = 1 << 20
+
+// Events receives the Events API, interactivity and slash command payloads
+// over http instead of socket mode. Every request must be signed with the
+// app's signing secret.
+type Events struct {
+	SigningSecret string
+	Bot           *Bot
+}
+
+func (events *Events) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/slack/events", events.verified(events.handleEvent))
+	mux.HandleFunc("/slack/commands", events.verified(events.handleCommand))
+	mux.HandleFunc("/slack/interactivity", events.verified(events.handleInteraction))
+}
+
+// verified checks the request signature and timestamp before handing the
+// body on. Requests older than five minutes are rejected.
+func (events *Events) verified(next func(w http.ResponseWriter, r *http.Request, body []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			http.Error(w, "could not read body", http.StatusBadRequest)
+			return
+		}
+
+		verifier, err := slack.NewSecretsVerifier(r.Header, events.SigningSecret)
+		if err != nil {
+			logger.Default.Warn("request signature rejected", "path", r.URL.Path, "err", err)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		if _, err := verifier.Write(body); err != nil {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		if err := verifier.Ensure(); err != nil {
+			logger.Default.Warn("request signature rejected", "path", r.URL.Path, "err", err)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r, body)
+	}
+}
+
+func (events *Events) handleEvent(w http.ResponseWriter, r *http.Request, body []byte) {
+	event, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		logger.Default.Warn("invalid event", "err", err)
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	if event.Type == slackevents.URLVerification {
+		var challenge slackevents.ChallengeResponse
+		if err := json.Unmarshal(body, &challenge); err != nil {
+			http.Error(w, "invalid challenge", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(challenge.Challenge))
+		return
+	}
+
+	logger.Default.Debug("event received", "type", event.InnerEvent.Type, "team_id", event.TeamID)
+
+	// slack resends events it thinks weren't acknowledged in time, drop the
+	// ones that already reached us
+	if callback, ok := event.Data.(*slackevents.EventsAPICallbackEvent); ok && callback.EventID != "" {
+		if _, seen := seenEvents.Get(callback.EventID); seen && r.Header.Get("X-Slack-Retry-Num") != "" {
+			logger.Default.Info("dropped event retry", "event_id", callback.EventID,
+				"retry", r.Header.Get("X-Slack-Retry-Num"), "reason", r.Header.Get("X-Slack-Retry-Reason"))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		seenEvents.Set(callback.EventID, true)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	metrics.QueueDepth.Inc()
+	go events.Bot.DispatchEvent(event, EnterpriseID(body))
+}
+
+func (events *Events) handleCommand(w http.ResponseWriter, r *http.Request, body []byte) {
+	cmd, err := slack.SlashCommandParse(r)
+	if err != nil {
+		http.Error(w, "invalid command", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	metrics.QueueDepth.Inc()
+	go events.Bot.DispatchCommand(cmd)
+}
+
+func (events *Events) handleInteraction(w http.ResponseWriter, r *http.Request, body []byte) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	payload := []byte(r.PostForm.Get("payload"))
+	var callback slack.InteractionCallback
+	if err := json.Unmarshal(payload, &callback); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	metrics.QueueDepth.Inc()
+	go events.Bot.DispatchInteraction(callback, EnterpriseID(payload))
+}
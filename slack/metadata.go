@@ -0,0 +1,103 @@
+package slack
+
+import (
+	"context"
+	"time"
+
+	"backlink/cache"
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+)
+
+// Slack metadata is cached per team. Profiles and channels are kept fresh by
+// the user_change and channel_rename events, the TTLs only bound how stale
+// they get if an event is missed. Permalinks never change.
+const (
+	cacheSize    = 1000
+	userTTL      = time.Hour
+	channelTTL   = time.Hour
+	permalinkTTL = 24 * time.Hour
+)
+
+type metadata struct {
+	users      *cache.Cache
+	channels   *cache.Cache
+	permalinks *cache.Cache
+}
+
+func newMetadata() metadata {
+	return metadata{
+		users:      cache.New("user", cacheSize, userTTL),
+		channels:   cache.New("channel", cacheSize, channelTTL),
+		permalinks: cache.New("permalink", cacheSize, permalinkTTL),
+	}
+}
+
+func (team *Team) User(ctx context.Context, userID string) (*slack.User, error) {
+	if user, ok := team.metadata.users.Get(userID); ok {
+		return user.(*slack.User), nil
+	}
+
+	var user *slack.User
+	err := traced(ctx, "users.info", func(ctx context.Context) (err error) {
+		user, err = team.API.GetUserInfoContext(ctx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	team.metadata.users.Set(userID, user)
+	return user, nil
+}
+
+func (team *Team) Channel(ctx context.Context, channelID string) (*slack.Channel, error) {
+	if channel, ok := team.metadata.channels.Get(channelID); ok {
+		return channel.(*slack.Channel), nil
+	}
+
+	var channel *slack.Channel
+	err := traced(ctx, "conversations.info", func(ctx context.Context) (err error) {
+		channel, err = team.API.GetConversationInfoContext(ctx, channelID, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	team.metadata.channels.Set(channelID, channel)
+	return channel, nil
+}
+
+func (team *Team) Permalink(ctx context.Context, channelID, ts string) (string, error) {
+	key := channelID + "/" + ts
+	if link, ok := team.metadata.permalinks.Get(key); ok {
+		return link.(string), nil
+	}
+
+	var link string
+	err := traced(ctx, "chat.getPermalink", func(ctx context.Context) (err error) {
+		link, err = team.API.GetPermalinkContext(ctx, &slack.PermalinkParameters{Channel: channelID, Ts: ts})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	team.metadata.permalinks.Set(key, link)
+	return link, nil
+}
+
+// metadataChanged applies the events that invalidate cached metadata.
+func (team *Team) metadataChanged(ctx context.Context, event interface{}) {
+	switch ev := event.(type) {
+	case *slack.UserChangeEvent:
+		user := ev.User
+		team.metadata.users.Set(user.ID, &user)
+	case *slack.TeamRenameEvent:
+		if err := db.RenameWorkspace(ctx, team.ID, ev.Name); err != nil {
+			logger.FromContext(ctx).Error("renaming workspace failed", "err", err)
+		}
+	case *slack.ChannelRenameEvent:
+		team.metadata.channels.Delete(ev.Channel.ID)
+	}
+}
@@ -2,10 +2,11 @@ package slack
 
 import (
 	"backlink/db"
-	"backlink/notion"
+	"backlink/logger"
+	"backlink/metrics"
+	"backlink/sink"
+	"backlink/tracing"
 	"context"
-	"fmt"
-	"log"
 	"regexp"
 	"strconv"
 	"strings"
@@ -13,103 +14,298 @@ import (
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
-	"github.com/slack-go/slack/socketmode"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func HandleMsgs(ev *slackevents.MessageEvent, client *socketmode.Client, api *slack.Client, session *notion.Session) {
-	var user string
-	var txt string
-	var userID string
-	var t string
-	var link string
-	var err error
+func (bot *Bot) HandleMsgs(ctx context.Context, ev *slackevents.MessageEvent, team *Team) {
+	ctx, span := tracing.Start(ctx, "slack message",
+		attribute.String("slack.team", team.ID),
+		attribute.String("slack.channel", ev.Channel),
+		attribute.String("slack.ts", ev.TimeStamp))
+	defer span.End()
+
+	api := team.API
+	log := logger.FromContext(ctx).With("channel", ev.Channel, "ts", ev.TimeStamp)
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		log = log.With("trace_id", traceID)
+	}
+	ctx = logger.NewContext(ctx, log)
+
 	backlinks := getBacklinks(ev.Text)
 	if len(backlinks) == 0 {
-		log.Println("no backlinks found")
+		log.Debug("no backlinks found")
+		return
+	}
+	metrics.BacklinksExtracted.Add(float64(len(backlinks)))
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		log.Error("workspace not found", "err", err)
 		return
 	}
+	root, ok := channelRoute(ctx, team, workspace, ev.Channel, ev.ChannelType)
+	if !ok {
+		log.Info("channel not captured")
+		return
+	}
+
+	msg := message{
+		Channel:     ev.Channel,
+		TS:          ev.TimeStamp,
+		UserID:      ev.User,
+		Text:        ev.Text,
+		TriggerUser: ev.User,
+		TriggerTS:   ev.TimeStamp,
+		// a redelivered event must not add the message twice
+		Once: true,
+	}
+
 	if ev.ThreadTimeStamp != "" {
-		log.Println("thread")
 		params := &slack.GetConversationRepliesParameters{
 			Timestamp: ev.ThreadTimeStamp,
 			ChannelID: ev.Channel,
 		}
-		msgs, _, _, err := api.GetConversationReplies(params)
+		var msgs []slack.Message
+		err := traced(ctx, "conversations.replies", func(ctx context.Context) (err error) {
+			msgs, _, _, err = api.GetConversationRepliesContext(ctx, params)
+			return err
+		})
 		if err != nil {
-			log.Println("err", err)
+			log.Error("loading thread parent failed", "thread_ts", ev.ThreadTimeStamp, "err", err)
 			return
 		}
-		txt = msgs[0].Text
-		userID = msgs[0].User
-		t = msgs[0].Timestamp
-
-		link, err = api.GetPermalink(&slack.PermalinkParameters{Channel: ev.Channel, Ts: msgs[0].Timestamp})
-		if err != nil {
-			log.Println("err", err)
+		if len(msgs) == 0 {
+			// deleted, or the bot can't see it anymore
+			log.Warn("thread parent not found", "thread_ts", ev.ThreadTimeStamp)
 			return
 		}
-	} else {
+		msg.Text = msgs[0].Text
+		msg.UserID = msgs[0].User
+		msg.TS = msgs[0].Timestamp
+		msg.TriggerTS = ev.ThreadTimeStamp
+		msg.TriggerInThread = true
+	}
 
-		txt = ev.Text
-		userID = ev.User
-		t = ev.TimeStamp
-		link, err = api.GetPermalink(&slack.PermalinkParameters{Channel: ev.Channel, Ts: ev.TimeStamp})
-		if err != nil {
-			log.Println("err", err)
-			return
+	results := bot.capture(ctx, team, workspace, root, msg, backlinks)
+	bot.confirm(ctx, team, msg, results)
+
+	recordOccurrences(ctx, team, db.Occurrence{
+		WorkspaceID: workspace.ID,
+		ChannelID:   ev.Channel,
+		UserID:      ev.User,
+		TS:          ev.TimeStamp,
+		ThreadTS:    ev.ThreadTimeStamp,
+	}, results)
+}
+
+// message is a slack message about to be captured.
+type message struct {
+	Channel string
+	TS      string
+	UserID  string
+	Text    string
+
+	// Reaction and ReactorID are set when the message was captured by
+	// reacting to it rather than by a [[link]] in its text.
+	Reaction  string
+	ReactorID string
+
+	// Once skips backlinks the message was already captured under.
+	Once bool
+
+	// TriggerUser and TriggerTS are who asked for the capture and where
+	// confirmations are threaded. TriggerInThread is set when the ask
+	// itself was a thread reply.
+	TriggerUser     string
+	TriggerTS       string
+	TriggerInThread bool
+}
+
+// captured is the outcome of writing a message under one backlink.
+type captured struct {
+	Backlink   string
+	BacklinkID uint
+	PageID     string
+	Created    bool
+	Err        error
+}
+
+// capture writes msg to the page of each backlink, creating pages as needed,
+// and records where each entry went. Nothing is returned when the author
+// opted out.
+func (bot *Bot) capture(ctx context.Context, team *Team, workspace db.Workspace, root string, msg message, backlinks []string) []captured {
+	target := team.Sink
+	log := logger.FromContext(ctx)
+
+	optedOut, err := db.IsOptedOut(ctx, workspace.ID, msg.UserID)
+	if err != nil {
+		// err on the side of not capturing
+		log.Error("loading opt out failed", "err", err)
+		return nil
+	}
+	if optedOut {
+		log.Info("author opted out")
+		return nil
+	}
+
+	failAll := func(err error) []captured {
+		var results []captured
+		for _, backlink := range backlinks {
+			results = append(results, captured{Backlink: backlink, Err: err})
 		}
+		return results
 	}
 
-	u, err := api.GetUserInfoContext(context.Background(), userID)
+	link, err := team.Permalink(ctx, msg.Channel, msg.TS)
 	if err != nil {
-		log.Println(err)
-		return
+		log.Error("permalink failed", "err", err)
+		return failAll(err)
 	}
-	user = u.Profile.RealName
-	timeS, err := convertTime(t)
-	log.Println(backlinks)
-	log.Println(txt)
-	log.Println(user)
-	log.Println(t)
-	log.Println(timeS.UTC())
 
-	teamName, err := GetTeamName(api)
+	u, err := team.User(ctx, msg.UserID)
 	if err != nil {
-		log.Println(err)
-		return
+		log.Error("user info failed", "err", err)
+		return failAll(err)
+	}
+	user := u.Profile.RealName
+	timeS, err := convertTime(msg.TS)
+	log.Debug("capturing message", "message_ts", msg.TS, "backlinks", len(backlinks))
+
+	txt, redacted := bot.Redactor.Redact(msg.Text)
+	if redacted > 0 {
+		log.Info("redacted message", "redactions", redacted, "message_ts", msg.TS)
 	}
-	header := fmt.Sprint(user, " ", timeS.Format(time.RFC822))
 
+	entry := sink.Entry{Author: user, Time: timeS, Text: txt, Permalink: link}
+
+	existing, err := db.GetBacklinksByName(ctx, workspace.ID, root, backlinks)
+	if err != nil {
+		log.Error("loading backlinks failed", "err", err)
+		return failAll(err)
+	}
+
+	var results []captured
+	seen := map[string]bool{}
 	for _, backlink := range backlinks {
-		if db.BacklinkExists(teamName, backlink) {
-			pID, err := db.GetNotionID(teamName, backlink)
+		// [[Atlas]] and [[atlas]] in one message are captured once
+		name := db.NormalizeName(backlink)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		result := captured{Backlink: backlink}
+
+		// only one capture creates a new page, the others wait for it and
+		// append to it
+		page, ok := existing[name]
+		claimed := false
+		if !ok || page.NotionID == "" {
+			page, claimed, err = db.ClaimBacklink(ctx, workspace.ID, root, backlink)
 			if err != nil {
-				log.Println("b", backlink, "err", err)
-				return
+				log.Error("writing backlink failed", "backlink", backlink, "err", err)
+				result.Err = err
+				results = append(results, result)
+				continue
 			}
-			err = addContent(session, pID, header, txt, link)
+		}
+		result.BacklinkID = page.ID
+		result.PageID = page.NotionID
+
+		var eID string
+		if claimed {
+			result.PageID, eID, err = target.CreatePage(ctx, root, backlink, entry)
 			if err != nil {
-				log.Println("b", backlink, "err", err)
-				return
+				log.Error("writing backlink failed", "backlink", backlink, "err", err)
+				if err := db.ReleaseBacklink(ctx, page.ID); err != nil {
+					log.Error("releasing backlink failed", "backlink", backlink, "err", err)
+				}
+				result.Err = err
+				results = append(results, result)
+				continue
+			}
+			result.Created = true
+			if err := db.SetBacklinkPage(ctx, page, result.PageID); err != nil {
+				log.Error("saving backlink failed", "backlink", backlink, "err", err)
 			}
 		} else {
-			pID, err := createNewBacklinkPage(session, backlink, header, txt, link)
+			if msg.Once {
+				// e.g. several people reacting only captures the message once
+				exists, err := db.EntryExists(ctx, workspace.ID, page.ID, msg.Channel, msg.TS)
+				if err != nil {
+					log.Error("writing backlink failed", "backlink", backlink, "err", err)
+					result.Err = err
+				}
+				if exists || err != nil {
+					results = append(results, result)
+					continue
+				}
+			}
+			eID, err = target.AppendEntry(ctx, result.PageID, entry)
 			if err != nil {
-				log.Println("b", backlink, "err", err)
-				return
+				log.Error("writing backlink failed", "backlink", backlink, "err", err)
+				result.Err = err
+				results = append(results, result)
+				continue
 			}
-			bldb := db.Backlink{LinkName: backlink, NotionID: pID}
-			db.AddBacklinkToWorkspace(teamName, bldb)
 		}
+		results = append(results, result)
+
+		// remember where the message went so its author can have it removed
+		err = db.AddEntry(ctx, db.Entry{
+			WorkspaceID: workspace.ID,
+			BacklinkID:  result.BacklinkID,
+			PageID:      result.PageID,
+			EntryID:     eID,
+			ChannelID:   msg.Channel,
+			MessageTS:   msg.TS,
+			AuthorID:    msg.UserID,
+			Reaction:    msg.Reaction,
+			ReactorID:   msg.ReactorID,
+		})
+		if err != nil {
+			log.Error("saving entry failed", "backlink", backlink, "err", err)
+		}
+	}
+
+	return results
+}
+
+// recordOccurrences saves mention, filled in with its permalink and time, for
+// every backlink it was captured under. Nothing is saved for users who opted
+// out, who can be someone else than the author of the captured message.
+func recordOccurrences(ctx context.Context, team *Team, mention db.Occurrence, results []captured) {
+	if len(results) == 0 {
+		return
+	}
 
+	optedOut, err := db.IsOptedOut(ctx, mention.WorkspaceID, mention.UserID)
+	if err != nil {
+		// err on the side of not recording
+		logger.FromContext(ctx).Error("loading opt out failed", "err", err)
+		return
+	}
+	if optedOut {
+		return
 	}
 
-	//	_, err = createNewBacklinkPage(session, backlinks[0], header, txt)
-	//	if err != nil {
-	//		log.Println("err", err)
-	//		return
-	//	}
+	link, err := team.Permalink(ctx, mention.ChannelID, mention.TS)
+	if err != nil {
+		logger.FromContext(ctx).Warn("occurrence permalink failed", "err", err)
+	}
+	mention.Permalink = link
+	mention.MentionedAt, _ = convertTime(mention.TS)
 
+	for _, result := range results {
+		if result.Err != nil || result.BacklinkID == 0 {
+			continue
+		}
+		occurrence := mention
+		occurrence.BacklinkID = result.BacklinkID
+		if err := db.AddOccurrence(ctx, occurrence); err != nil {
+			logger.FromContext(ctx).Error("saving occurrence failed", "backlink", result.Backlink, "err", err)
+		}
+	}
 }
 
 func getBacklinks(msg string) []string {
@@ -121,14 +317,6 @@ func getBacklinks(msg string) []string {
 	return b
 }
 
-func GetTeamName(api *slack.Client) (string, error) {
-	resp, err := api.AuthTest()
-	if err != nil {
-		return "", err
-	}
-	return resp.Team, nil
-}
-
 func convertTime(ut string) (time.Time, error) {
 	uts := strings.Split(ut, ".")
 	s, err := strconv.Atoi(uts[0])
@@ -138,108 +326,3 @@ func convertTime(ut string) (time.Time, error) {
 	}
 	return time.Unix(int64(s), int64(ns)), nil
 }
-
-func createNewBacklinkPage(session *notion.Session, title, header, para, link string) (string, error) {
-
-	blocks := []notion.Block{
-		notion.Block{
-			Object: "block",
-			Type:   "heading_3",
-			Heading3: &notion.Text{
-				Text: []notion.RichText{
-					notion.RichText{
-						Type: "text",
-						Text: &notion.TextInfo{
-							Content: header,
-						},
-					},
-				},
-			},
-		},
-		notion.Block{
-			Object: "block",
-			Type:   "paragraph",
-			Paragraph: &notion.TextTree{
-				Text: []notion.RichText{
-					notion.RichText{
-						Type: "text",
-						Text: &notion.TextInfo{
-							Content: para,
-						},
-					},
-				},
-			},
-		},
-		notion.Block{
-			Object: "block",
-			Type:   "paragraph",
-			Paragraph: &notion.TextTree{
-				Text: []notion.RichText{
-					notion.RichText{
-						Type: "text",
-						Text: &notion.TextInfo{
-							Content: "Go To Message",
-							Link: &notion.Link{
-								URL: link,
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-	p, err := session.Pages[0].AppendPageWithBlocks(title, blocks)
-	return p.Id, err
-}
-
-func addContent(session *notion.Session, pageID, header, para, link string) error {
-	blocks := []notion.Block{
-		notion.Block{
-			Object: "block",
-			Type:   "heading_3",
-			Heading3: &notion.Text{
-				Text: []notion.RichText{
-					notion.RichText{
-						Type: "text",
-						Text: &notion.TextInfo{
-							Content: header,
-						},
-					},
-				},
-			},
-		},
-		notion.Block{
-			Object: "block",
-			Type:   "paragraph",
-			Paragraph: &notion.TextTree{
-				Text: []notion.RichText{
-					notion.RichText{
-						Type: "text",
-						Text: &notion.TextInfo{
-							Content: para,
-						},
-					},
-				},
-			},
-		},
-		notion.Block{
-			Object: "block",
-			Type:   "paragraph",
-			Paragraph: &notion.TextTree{
-				Text: []notion.RichText{
-					notion.RichText{
-						Type: "text",
-						Text: &notion.TextInfo{
-							Content: "Go To Message",
-							Link: &notion.Link{
-								URL: link,
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-	_, err := session.Client.AppendChildren(pageID, blocks)
-	return err
-}
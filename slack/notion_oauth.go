@@ -0,0 +1,85 @@
+package slack
+
+import (
+	"net/http"
+	"strconv"
+
+	"backlink/db"
+	"backlink/logger"
+	"backlink/notion"
+)
+
+// NotionOAuth connects a slack team to a notion workspace through notion's
+// public integration OAuth flow.
+type NotionOAuth struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	Teams *Teams
+
+	states *states
+}
+
+func NewNotionOAuth(clientID, clientSecret, redirectURL string, teams *Teams) *NotionOAuth {
+	return &NotionOAuth{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Teams:        teams,
+		states:       newStates(),
+	}
+}
+
+// AuthorizeURL returns the link that connects a workspace to notion.
+func (oauth *NotionOAuth) AuthorizeURL(workspaceID uint) (string, error) {
+	state, err := oauth.states.New(strconv.FormatUint(uint64(workspaceID), 10))
+	if err != nil {
+		return "", err
+	}
+
+	return notion.AuthorizeURL(oauth.ClientID, oauth.RedirectURL, state), nil
+}
+
+// Callback exchanges the code notion redirects back with for an access token
+// and stores it on the workspace that asked for the link.
+func (oauth *NotionOAuth) Callback(w http.ResponseWriter, r *http.Request) {
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		http.Error(w, "notion connection cancelled: "+errMsg, http.StatusBadRequest)
+		return
+	}
+
+	state, ok := oauth.states.Take(r.URL.Query().Get("state"))
+	id, err := strconv.ParseUint(state, 10, 32)
+	if !ok || err != nil {
+		http.Error(w, "invalid or expired link, run /backlink notion again", http.StatusBadRequest)
+		return
+	}
+	log := logger.Default.With("correlation_id", logger.NewID(), "workspace_id", id, "event", "notion_oauth")
+
+	token, err := notion.ExchangeCode(oauth.ClientID, oauth.ClientSecret, r.URL.Query().Get("code"), oauth.RedirectURL)
+	if err != nil {
+		log.Error("notion oauth exchange failed", "err", err)
+		http.Error(w, "could not connect notion", http.StatusBadGateway)
+		return
+	}
+
+	ctx := logger.NewContext(r.Context(), log)
+	err = db.SaveNotionAuth(ctx, uint(id), token.AccessToken, token.BotId, token.WorkspaceId, token.WorkspaceName)
+	if err != nil {
+		log.Error("saving notion connection failed", "err", err)
+		http.Error(w, "could not save notion connection", http.StatusInternalServerError)
+		return
+	}
+
+	if workspace, err := db.GetWorkspace(ctx, uint(id)); err == nil {
+		oauth.Teams.Forget(workspace.EnterpriseID, workspace.TeamID)
+	}
+
+	log.Info("notion connected", "notion_workspace", token.WorkspaceName)
+	w.Write([]byte("Connected to " + token.WorkspaceName + ". Run /backlink setup in slack to pick the page backlinks go under."))
+}
+
+func (oauth *NotionOAuth) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/notion/oauth/callback", oauth.Callback)
+}
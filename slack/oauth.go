@@ -0,0 +1,172 @@
+package slack
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+)
+
+// BotScopes are requested when a workspace installs the app.
+var BotScopes = "app_mentions:read,reactions:read,channels:history,channels:read,groups:history,groups:read,im:history,mpim:history,chat:write,users:read,commands"
+
+// OAuth implements slack's OAuth v2 install flow and stores the resulting bot
+// token for the team.
+type OAuth struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// Defaults for the notion side of a new installation.
+	NotionToken string
+	RootPages   string
+
+	Teams *Teams
+
+	states *states
+}
+
+func NewOAuth(clientID, clientSecret, redirectURL string, teams *Teams) *OAuth {
+	return &OAuth{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Teams:        teams,
+		states:       newStates(),
+	}
+}
+
+// Install redirects to slack's authorize page.
+func (oauth *OAuth) Install(w http.ResponseWriter, r *http.Request) {
+	state, err := oauth.states.New("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{
+		"client_id":    {oauth.ClientID},
+		"scope":        {BotScopes},
+		"redirect_uri": {oauth.RedirectURL},
+		"state":        {state},
+	}
+
+	http.Redirect(w, r, "https://slack.com/oauth/v2/authorize?"+query.Encode(), http.StatusFound)
+}
+
+// Callback exchanges the code slack redirects back with for a bot token.
+func (oauth *OAuth) Callback(w http.ResponseWriter, r *http.Request) {
+	log := logger.Default.With("correlation_id", logger.NewID(), "event", "slack_oauth")
+
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		http.Error(w, "install cancelled: "+errMsg, http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := oauth.states.Take(r.URL.Query().Get("state")); !ok {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := slack.GetOAuthV2Response(http.DefaultClient, oauth.ClientID, oauth.ClientSecret,
+		r.URL.Query().Get("code"), oauth.RedirectURL)
+	if err != nil {
+		log.Error("oauth exchange failed", "err", err)
+		http.Error(w, "could not complete install", http.StatusBadGateway)
+		return
+	}
+
+	// an install for a whole Enterprise Grid org comes without a team, it is
+	// saved under the org's id
+	if resp.Team.ID == "" && resp.Enterprise.ID == "" {
+		log.Error("oauth exchange failed", "err", "no team or enterprise in response")
+		http.Error(w, "could not complete install", http.StatusBadGateway)
+		return
+	}
+
+	ctx := logger.NewContext(r.Context(), log.With("team_id", resp.Team.ID, "enterprise_id", resp.Enterprise.ID))
+	err = db.SaveInstallation(ctx, db.Workspace{
+		SlackTeam:    resp.Team.Name,
+		TeamID:       resp.Team.ID,
+		EnterpriseID: resp.Enterprise.ID,
+		BotToken:     resp.AccessToken,
+		BotUserID:    resp.BotUserID,
+		NotionToken:  oauth.NotionToken,
+		RootPages:    oauth.RootPages,
+	})
+	if err != nil {
+		log.Error("saving install failed", "err", err)
+		http.Error(w, "could not save install", http.StatusInternalServerError)
+		return
+	}
+
+	oauth.Teams.Forget(resp.Enterprise.ID, resp.Team.ID)
+
+	name := resp.Team.Name
+	if resp.Team.ID == "" {
+		name = resp.Enterprise.Name
+	}
+
+	log.Info("installed", "team_id", resp.Team.ID, "enterprise_id", resp.Enterprise.ID, "team", name)
+	w.Write([]byte("Backlink bot installed to " + name + ", you can close this page."))
+}
+
+func (oauth *OAuth) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/slack/install", oauth.Install)
+	mux.HandleFunc("/slack/oauth/callback", oauth.Callback)
+}
+
+// states hands out single use, expiring oauth state parameters, each
+// remembering a value such as the team that started the flow.
+type states struct {
+	lock   sync.Mutex
+	values map[string]stateValue
+}
+
+type stateValue struct {
+	value   string
+	expires time.Time
+}
+
+func newStates() *states {
+	return &states{values: map[string]stateValue{}}
+}
+
+func (s *states) New(value string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(buf)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, v := range s.values {
+		if time.Now().After(v.expires) {
+			delete(s.values, key)
+		}
+	}
+	s.values[state] = stateValue{value: value, expires: time.Now().Add(10 * time.Minute)}
+
+	return state, nil
+}
+
+func (s *states) Take(state string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, ok := s.values[state]
+	delete(s.values, state)
+	if !ok || time.Now().After(v.expires) {
+		return "", false
+	}
+	return v.value, true
+}
@@ -0,0 +1,113 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+
+	"backlink/db"
+	"backlink/logger"
+	"backlink/sink"
+
+	"github.com/slack-go/slack"
+)
+
+// anonymized replaces an entry when its author asks to be forgotten but the
+// mention itself should stay on the page.
+const anonymized = "(message removed at the author's request)"
+
+// optOut handles `/backlink optout [off]`.
+func (bot *Bot) optOut(ctx context.Context, cmd slack.SlashCommand, team *Team, args []string) {
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		reply(ctx, team, cmd, "This workspace isn't set up yet.")
+		return
+	}
+
+	optOut := len(args) < 2 || args[1] != "off"
+	if err := db.SetOptOut(ctx, workspace.ID, cmd.UserID, optOut); err != nil {
+		logger.FromContext(ctx).Error("opt out failed", "err", err)
+		reply(ctx, team, cmd, "Could not save your choice, try again.")
+		return
+	}
+
+	if optOut {
+		reply(ctx, team, cmd, "Your messages won't be captured anymore. Use `/backlink forget-me` to remove what was already captured.")
+	} else {
+		reply(ctx, team, cmd, "Your messages will be captured again.")
+	}
+}
+
+// forgetMe handles `/backlink forget-me [anonymize]`. Every entry sourced from
+// the user's messages is deleted, or with anonymize replaced by a
+// placeholder, and the user is opted out so nothing new is captured.
+func (bot *Bot) forgetMe(ctx context.Context, cmd slack.SlashCommand, team *Team, args []string) {
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		reply(ctx, team, cmd, "This workspace isn't set up yet.")
+		return
+	}
+
+	anonymize := len(args) > 1 && args[1] == "anonymize"
+
+	if err := db.SetOptOut(ctx, workspace.ID, cmd.UserID, true); err != nil {
+		logger.FromContext(ctx).Error("opt out failed", "err", err)
+		reply(ctx, team, cmd, "Could not opt you out, nothing was removed. Try again.")
+		return
+	}
+
+	// which pages they mentioned is about them too, whatever happens to
+	// the entries
+	if err := db.DeleteOccurrencesByUser(ctx, workspace.ID, cmd.UserID); err != nil {
+		logger.FromContext(ctx).Error("deleting occurrences failed", "err", err)
+		reply(ctx, team, cmd, "Could not remove your mentions, nothing was removed. Try again.")
+		return
+	}
+
+	entries, err := db.GetEntriesByAuthor(ctx, workspace.ID, cmd.UserID)
+	if err != nil {
+		logger.FromContext(ctx).Error("loading entries failed", "err", err)
+		reply(ctx, team, cmd, "Could not look up your messages, try again.")
+		return
+	}
+
+	removed, failed := 0, 0
+	pages := map[string]bool{}
+
+	for _, entry := range entries {
+		if anonymize {
+			when, _ := convertTime(entry.MessageTS)
+			err = team.Sink.UpdateEntry(ctx, entry.PageID, entry.EntryID, sink.Entry{
+				Author: "Anonymous",
+				Time:   when,
+				Text:   anonymized,
+			})
+		} else {
+			err = team.Sink.DeleteEntry(ctx, entry.PageID, entry.EntryID)
+		}
+
+		if err != nil {
+			logger.FromContext(ctx).Error("forgetting entry failed", "entry_id", entry.ID, "err", err)
+			failed++
+			continue
+		}
+
+		if err := db.DeleteEntry(ctx, entry.ID); err != nil {
+			logger.FromContext(ctx).Error("forgetting entry failed", "entry_id", entry.ID, "err", err)
+		}
+		removed++
+		pages[entry.PageID] = true
+	}
+
+	verb := "Deleted"
+	if anonymize {
+		verb = "Anonymized"
+	}
+
+	report := fmt.Sprintf("%s %d captured messages across %d backlink pages. You are opted out of future captures.",
+		verb, removed, len(pages))
+	if failed > 0 {
+		report += fmt.Sprintf("\n%d could not be removed, run `/backlink forget-me` again to retry them.", failed)
+	}
+
+	reply(ctx, team, cmd, report)
+}
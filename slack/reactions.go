@@ -0,0 +1,212 @@
+package slack
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+var errNoMessage = errors.New("message not found")
+
+const (
+	reactionPromptAction   = "backlink_reaction_prompt"
+	reactionPromptCallback = "backlink_reaction"
+)
+
+// HandleReactionAdded captures the message that was reacted to. An emoji
+// mapped to a backlink appends it straight away, the prompt emoji asks the
+// reacting user which backlink to use.
+func (bot *Bot) HandleReactionAdded(ctx context.Context, ev *slackevents.ReactionAddedEvent, team *Team) {
+	if ev.Item.Type != "message" || !bot.allowed(ev.Item.Channel) {
+		return
+	}
+
+	if backlink, ok := bot.Reactions.Backlinks[ev.Reaction]; ok {
+		bot.captureReaction(ctx, team, ev.Item.Channel, ev.Item.Timestamp, ev.Reaction, ev.User, backlink)
+		return
+	}
+
+	if bot.Reactions.Prompt != "" && ev.Reaction == bot.Reactions.Prompt {
+		bot.promptBacklink(ctx, team, ev.Item.Channel, ev.Item.Timestamp, ev.User)
+	}
+}
+
+// HandleReactionRemoved deletes the entries the same user's reaction created.
+func (bot *Bot) HandleReactionRemoved(ctx context.Context, ev *slackevents.ReactionRemovedEvent, team *Team) {
+	if ev.Item.Type != "message" {
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("workspace not found", "err", err)
+		return
+	}
+
+	entries, err := db.GetEntriesByReaction(ctx, workspace.ID, ev.Item.Channel, ev.Item.Timestamp, ev.Reaction, ev.User)
+	if err != nil {
+		logger.FromContext(ctx).Error("loading entries failed", "err", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if err := team.Sink.DeleteEntry(ctx, entry.PageID, entry.EntryID); err != nil {
+			logger.FromContext(ctx).Error("deleting entry failed", "entry_id", entry.ID, "err", err)
+			continue
+		}
+		if err := db.DeleteEntry(ctx, entry.ID); err != nil {
+			logger.FromContext(ctx).Error("deleting entry failed", "entry_id", entry.ID, "err", err)
+		}
+	}
+}
+
+func (bot *Bot) captureReaction(ctx context.Context, team *Team, channel, ts, reaction, reactorID, backlink string) {
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		logger.FromContext(ctx).Error("workspace not found", "err", err)
+		return
+	}
+	channelType, err := conversationType(ctx, team, channel)
+	if err != nil {
+		logger.FromContext(ctx).Error("channel info failed", "channel", channel, "err", err)
+		return
+	}
+	root, ok := channelRoute(ctx, team, workspace, channel, channelType)
+	if !ok {
+		logger.FromContext(ctx).Info("channel not captured", "channel", channel)
+		return
+	}
+
+	msg, err := getMessage(ctx, team.API, channel, ts)
+	if err != nil {
+		logger.FromContext(ctx).Error("loading reacted message failed", "err", err)
+		return
+	}
+
+	msg.Reaction = reaction
+	msg.ReactorID = reactorID
+	msg.Once = true
+	msg.TriggerUser = reactorID
+	msg.TriggerTS = ts
+
+	results := bot.capture(ctx, team, workspace, root, msg, []string{backlink})
+	bot.confirm(ctx, team, msg, results)
+}
+
+// promptBacklink shows the reacting user a button that opens a modal asking
+// for the backlink. Ephemeral messages can't hold inputs so it takes the
+// extra click.
+func (bot *Bot) promptBacklink(ctx context.Context, team *Team, channel, ts, userID string) {
+	button := slack.NewButtonBlockElement(reactionPromptAction, channel+" "+ts,
+		slack.NewTextBlockObject(slack.PlainTextType, "Add to backlink", false, false))
+
+	_, err := team.API.PostEphemeral(channel, userID,
+		slack.MsgOptionText("Add this message to a backlink?", false),
+		slack.MsgOptionBlocks(
+			slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, "Add this message to a backlink?", false, false), nil, nil),
+			slack.NewActionBlock("", button),
+		),
+	)
+	if err != nil {
+		logger.FromContext(ctx).Error("backlink prompt failed", "err", err)
+	}
+}
+
+func (bot *Bot) openBacklinkModal(ctx context.Context, callback slack.InteractionCallback, action *slack.BlockAction, team *Team) {
+	input := slack.NewPlainTextInputBlockElement(
+		slack.NewTextBlockObject(slack.PlainTextType, "Atlas", false, false), "backlink")
+
+	view := slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      reactionPromptCallback,
+		PrivateMetadata: action.Value,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Add to backlink", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Add", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks: slack.Blocks{BlockSet: []slack.Block{
+			slack.NewInputBlock("backlink", slack.NewTextBlockObject(slack.PlainTextType, "Backlink", false, false), input),
+		}},
+	}
+
+	if _, err := team.API.OpenView(callback.TriggerID, view); err != nil {
+		logger.FromContext(ctx).Error("opening view failed", "err", err)
+	}
+}
+
+func (bot *Bot) submitBacklinkModal(ctx context.Context, callback slack.InteractionCallback, team *Team) {
+	target := strings.Fields(callback.View.PrivateMetadata)
+	if len(target) != 2 {
+		return
+	}
+
+	backlink := strings.TrimSpace(callback.View.State.Values["backlink"]["backlink"].Value)
+	backlink = strings.TrimSuffix(strings.TrimPrefix(backlink, "[["), "]]")
+	if backlink == "" {
+		return
+	}
+
+	bot.captureReaction(ctx, team, target[0], target[1], bot.Reactions.Prompt, callback.User.ID, backlink)
+}
+
+// getMessage fetches a single message, which may be a thread reply.
+func getMessage(ctx context.Context, api *slack.Client, channel, ts string) (message, error) {
+	history, err := api.GetConversationHistory(&slack.GetConversationHistoryParameters{
+		ChannelID: channel,
+		Latest:    ts,
+		Oldest:    ts,
+		Inclusive: true,
+		Limit:     1,
+	})
+	if err != nil {
+		return message{}, err
+	}
+
+	msgs := history.Messages
+	if len(msgs) == 0 || msgs[0].Timestamp != ts {
+		// replies don't show up in the channel history
+		err = traced(ctx, "conversations.replies", func(ctx context.Context) (err error) {
+			msgs, _, _, err = api.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+				ChannelID: channel,
+				Timestamp: ts,
+			})
+			return err
+		})
+		if err != nil {
+			return message{}, err
+		}
+	}
+
+	for _, msg := range msgs {
+		if msg.Timestamp == ts {
+			return message{Channel: channel, TS: ts, UserID: msg.User, Text: msg.Text}, nil
+		}
+	}
+
+	return message{}, errNoMessage
+}
+
+// conversationType maps a conversation to the channel_type values message
+// events carry. Callers must not capture when it fails, the channel could be
+// private or a DM.
+func conversationType(ctx context.Context, team *Team, channel string) (string, error) {
+	info, err := team.Channel(ctx, channel)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case info.IsIM:
+		return "im", nil
+	case info.IsMpIM:
+		return "mpim", nil
+	case info.IsPrivate:
+		return "group", nil
+	}
+	return "channel", nil
+}
@@ -0,0 +1,74 @@
+package slack
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"backlink/db"
+	"backlink/logger"
+)
+
+// channelRoute applies a workspace's channel rules to a message. It returns
+// the root page new backlink pages go under, empty for the default, and
+// whether the message should be captured at all.
+func channelRoute(ctx context.Context, team *Team, workspace db.Workspace, channel string, channelType string) (string, bool) {
+	switch channelType {
+	case "im", "mpim":
+		if workspace.IgnoreDMs {
+			return "", false
+		}
+	case "group":
+		if workspace.IgnorePrivate {
+			return "", false
+		}
+	}
+
+	rules, err := db.GetChannelRules(ctx, workspace.ID)
+	if err != nil {
+		// don't write anywhere we might not be allowed to
+		logger.FromContext(ctx).Error("loading channel rules failed", "err", err)
+		return "", false
+	}
+
+	var patterns []db.ChannelRule
+	for _, rule := range rules {
+		if rule.ChannelID == channel {
+			return applyRule(rule)
+		}
+		if rule.Pattern != "" {
+			patterns = append(patterns, rule)
+		}
+	}
+
+	if len(patterns) > 0 {
+		info, err := team.Channel(ctx, channel)
+		if err != nil {
+			logger.FromContext(ctx).Warn("channel info failed", "channel", channel, "err", err)
+			return "", false
+		}
+
+		// the most specific pattern wins
+		sort.SliceStable(patterns, func(i, j int) bool {
+			return len(patterns[i].Pattern) > len(patterns[j].Pattern)
+		})
+
+		for _, rule := range patterns {
+			if matched, _ := path.Match(rule.Pattern, info.Name); matched {
+				return applyRule(rule)
+			}
+		}
+	}
+
+	return "", !workspace.RequireOptIn
+}
+
+func applyRule(rule db.ChannelRule) (string, bool) {
+	switch rule.Action {
+	case db.RuleDeny:
+		return "", false
+	case db.RuleRoute:
+		return rule.RootPage, true
+	}
+	return "", true
+}
@@ -1,70 +1,99 @@
 package slack
 
 import (
-	"log"
-	"os"
+	"errors"
+	"sync/atomic"
 
-	"backlink/notion"
+	"backlink/logger"
+	"backlink/metrics"
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
 	"github.com/slack-go/slack/socketmode"
 )
 
-func Run(appToken, botToken string, session *notion.Session) {
-	log.Println("running slack bot")
+// connected is 1 while the socket mode connection is up.
+var connected int32
 
+// SocketModeStatus is a readiness check for the socket mode connection.
+func SocketModeStatus() error {
+	if atomic.LoadInt32(&connected) == 0 {
+		return errors.New("not connected")
+	}
+	return nil
+}
+
+func Run(appToken string, bot *Bot) {
+	log := logger.Default.With("component", "socket_mode")
+	log.Info("running slack bot")
+
+	// the socket mode connection only needs the app level token, events
+	// are answered with the bot token of the team they came from
 	api := slack.New(
-		botToken,
+		"",
 		slack.OptionDebug(false),
-		slack.OptionLog(log.New(os.Stdout, "api: ", log.Lshortfile|log.LstdFlags)),
+		slack.OptionLog(logger.Default.With("component", "slack_api")),
 		slack.OptionAppLevelToken(appToken),
 	)
 
 	client := socketmode.New(
 		api,
 		socketmode.OptionDebug(false),
-		socketmode.OptionLog(log.New(os.Stdout, "socketmode: ", log.Lshortfile|log.LstdFlags)),
+		socketmode.OptionLog(log),
 	)
 
 	go func() {
 		for evt := range client.Events {
-			log.Println("e...")
 			switch evt.Type {
 			case socketmode.EventTypeConnecting:
-				log.Println("Connecting to slack with socket mode...")
+				log.Info("connecting to slack with socket mode")
+				atomic.StoreInt32(&connected, 0)
 			case socketmode.EventTypeConnectionError:
-				log.Println("Connection failed. Retrying later...")
+				log.Warn("connection failed, retrying later")
+				atomic.StoreInt32(&connected, 0)
 			case socketmode.EventTypeConnected:
-				log.Println("Connected to Slack with Socket Mode.")
+				log.Info("connected to slack with socket mode")
+				atomic.StoreInt32(&connected, 1)
+			case socketmode.EventTypeDisconnect:
+				log.Warn("disconnected from slack")
+				atomic.StoreInt32(&connected, 0)
 			case socketmode.EventTypeEventsAPI:
 				eventsAPIEvent, ok := evt.Data.(slackevents.EventsAPIEvent)
 				if !ok {
-					log.Printf("Ignored %+v\n", evt)
+					log.Warn("ignored socket mode event", "type", evt.Type)
 
 					continue
 				}
-				log.Printf("Event received: %+v\n", eventsAPIEvent)
+				log.Debug("event received", "type", eventsAPIEvent.InnerEvent.Type, "team_id", eventsAPIEvent.TeamID)
 
 				client.Ack(*evt.Request)
+				metrics.QueueDepth.Inc()
 
-				switch eventsAPIEvent.Type {
-				case slackevents.CallbackEvent:
-					innerEvent := eventsAPIEvent.InnerEvent
-					switch ev := innerEvent.Data.(type) {
-					case *slackevents.AppMentionEvent:
-						_, _, err := api.PostMessage(ev.Channel, slack.MsgOptionText("Yes, hello.", false))
-						log.Printf("bot mentioned")
-						if err != nil {
-							log.Printf("failed posting message: %v", err)
-						}
-					case *slackevents.MessageEvent:
-						log.Printf("msg sent")
-						HandleMsgs(ev, client, api, session)
-					}
-				default:
-					client.Debugf("unsupported Events API event received")
+				go bot.DispatchEvent(eventsAPIEvent, EnterpriseID(evt.Request.Payload))
+			case socketmode.EventTypeSlashCommand:
+				cmd, ok := evt.Data.(slack.SlashCommand)
+				if !ok {
+					log.Warn("ignored socket mode event", "type", evt.Type)
+
+					continue
 				}
+
+				client.Ack(*evt.Request)
+				metrics.QueueDepth.Inc()
+
+				go bot.DispatchCommand(cmd)
+			case socketmode.EventTypeInteractive:
+				callback, ok := evt.Data.(slack.InteractionCallback)
+				if !ok {
+					log.Warn("ignored socket mode event", "type", evt.Type)
+
+					continue
+				}
+
+				client.Ack(*evt.Request)
+				metrics.QueueDepth.Inc()
+
+				go bot.DispatchInteraction(callback, EnterpriseID(evt.Request.Payload))
 			}
 		}
 
@@ -72,6 +101,6 @@ func Run(appToken, botToken string, session *notion.Session) {
 
 	err := client.Run()
 	if err != nil {
-		log.Println(err)
+		log.Error("socket mode stopped", "err", err)
 	}
 }
@@ -0,0 +1,103 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"backlink/db"
+	"backlink/logger"
+
+	"github.com/slack-go/slack"
+)
+
+// statsDays is how far back /backlink stats looks.
+const statsDays = 90
+
+// stats handles `/backlink stats <backlink>`.
+func (bot *Bot) stats(ctx context.Context, cmd slack.SlashCommand, team *Team, args []string) {
+	name := strings.TrimSuffix(strings.TrimPrefix(strings.Join(args[1:], " "), "[["), "]]")
+	if name == "" {
+		reply(ctx, team, cmd, usage)
+		return
+	}
+
+	workspace, err := db.GetInstallation(ctx, team.EnterpriseID, team.ID)
+	if err != nil {
+		reply(ctx, team, cmd, "This workspace isn't set up yet.")
+		return
+	}
+
+	backlinks, err := db.FindBacklinks(ctx, workspace.ID, name)
+	if err != nil {
+		logger.FromContext(ctx).Error("finding backlinks failed", "err", err)
+		reply(ctx, team, cmd, "Could not look up "+name+", try again.")
+		return
+	}
+	if len(backlinks) == 0 {
+		reply(ctx, team, cmd, "Nobody has mentioned [["+name+"]] yet.")
+		return
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -statsDays)
+
+	var sections []string
+	for _, backlink := range backlinks {
+		section, err := backlinkStats(ctx, team, backlink, from, to)
+		if err != nil {
+			logger.FromContext(ctx).Error("backlink stats failed", "backlink_id", backlink.ID, "err", err)
+			reply(ctx, team, cmd, "Could not look up "+name+", try again.")
+			return
+		}
+		sections = append(sections, section)
+	}
+
+	reply(ctx, team, cmd, strings.Join(sections, "\n\n"))
+}
+
+func backlinkStats(ctx context.Context, team *Team, backlink db.Backlink, from, to time.Time) (string, error) {
+	weeks, err := db.MentionsOverTime(ctx, backlink.ID, from, to, "week")
+	if err != nil {
+		return "", err
+	}
+	channels, err := db.TopChannels(ctx, backlink.ID, from, to, 5)
+	if err != nil {
+		return "", err
+	}
+	users, err := db.TopContributors(ctx, backlink.ID, from, to, 5)
+	if err != nil {
+		return "", err
+	}
+
+	total := 0
+	for _, week := range weeks {
+		total += week.Count
+	}
+
+	lines := []string{fmt.Sprintf("*%s*, %d %s in the last %d days", pageLink(team, backlink), total, plural(total, "mention"), statsDays)}
+	if total == 0 {
+		return lines[0], nil
+	}
+
+	var counts []string
+	for _, week := range weeks {
+		counts = append(counts, fmt.Sprintf("%s: %d", week.Key, week.Count))
+	}
+	lines = append(lines, "Per week: "+strings.Join(counts, ", "))
+
+	var where []string
+	for _, channel := range channels {
+		where = append(where, fmt.Sprintf("<#%s> %d", channel.Key, channel.Count))
+	}
+	lines = append(lines, "Channels: "+strings.Join(where, ", "))
+
+	var who []string
+	for _, user := range users {
+		who = append(who, fmt.Sprintf("<@%s> %d", user.Key, user.Count))
+	}
+	lines = append(lines, "Mentioned by: "+strings.Join(who, ", "))
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,159 @@
+package slack
+
+import (
+	"context"
+	"sync"
+
+	"backlink/db"
+	"backlink/logger"
+	"backlink/sink"
+
+	"github.com/slack-go/slack"
+)
+
+// Team is everything needed to handle events for one installed workspace.
+type Team struct {
+	ID           string
+	EnterpriseID string
+	API          *slack.Client
+	Sink         sink.Sink
+
+	metadata metadata
+}
+
+// Teams builds and caches a Team per slack team from the installations
+// stored in the db.
+type Teams struct {
+	// NewSink creates the sink a workspace's backlinks are written to.
+	NewSink func(workspace db.Workspace) (sink.Sink, error)
+
+	lock  sync.Mutex
+	teams map[teamKey]*loadingTeam
+}
+
+// teamKey identifies a team by the ids of the event envelope, EnterpriseID is
+// empty outside Enterprise Grid.
+type teamKey struct {
+	EnterpriseID string
+	TeamID       string
+}
+
+// loadingTeam is a team in the cache, ready is closed once team or err is
+// set.
+type loadingTeam struct {
+	ready chan struct{}
+	team  *Team
+	err   error
+}
+
+func NewTeams(newSink func(workspace db.Workspace) (sink.Sink, error)) *Teams {
+	return &Teams{
+		NewSink: newSink,
+		teams:   map[teamKey]*loadingTeam{},
+	}
+}
+
+// Get returns the team for the enterprise and team id of an event, loading
+// its installation on first use. A team without an install of its own uses
+// the install of its org. Loading a team, which can mean reading its notion
+// pages, only holds up events of the same team.
+func (teams *Teams) Get(ctx context.Context, enterpriseID, teamID string) (*Team, error) {
+	key := teamKey{EnterpriseID: enterpriseID, TeamID: teamID}
+
+	teams.lock.Lock()
+	entry, ok := teams.teams[key]
+	if !ok {
+		entry = &loadingTeam{ready: make(chan struct{})}
+		teams.teams[key] = entry
+	}
+	teams.lock.Unlock()
+
+	if !ok {
+		entry.team, entry.err = teams.load(ctx, key)
+		if entry.err != nil {
+			// the next event tries again
+			teams.lock.Lock()
+			if teams.teams[key] == entry {
+				delete(teams.teams, key)
+			}
+			teams.lock.Unlock()
+		}
+		close(entry.ready)
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.team, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (teams *Teams) load(ctx context.Context, key teamKey) (*Team, error) {
+	workspace, err := db.GetInstallation(ctx, key.EnterpriseID, key.TeamID)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := teams.NewSink(workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	team := &Team{
+		ID:           key.TeamID,
+		EnterpriseID: key.EnterpriseID,
+		API:          NewAPI(workspace.BotToken),
+		Sink:         target,
+
+		metadata: newMetadata(),
+	}
+
+	return team, nil
+}
+
+// Forget drops the cached teams of an installation so the next event reloads
+// it, an install without a team id drops every team of its org.
+func (teams *Teams) Forget(enterpriseID, teamID string) {
+	teams.lock.Lock()
+	defer teams.lock.Unlock()
+
+	for key := range teams.teams {
+		if teamID != "" && key.TeamID == teamID || teamID == "" && key.EnterpriseID == enterpriseID {
+			delete(teams.teams, key)
+		}
+	}
+}
+
+// InstallToken stores a bot token that was not obtained through OAuth, e.g.
+// SLACK_BOT_TOKEN for a single workspace deployment.
+func (teams *Teams) InstallToken(ctx context.Context, botToken string, notionToken string, rootPages string) error {
+	resp, err := NewAPI(botToken).AuthTest()
+	if err != nil {
+		return err
+	}
+
+	err = db.SaveInstallation(ctx, db.Workspace{
+		SlackTeam:    resp.Team,
+		TeamID:       resp.TeamID,
+		EnterpriseID: resp.EnterpriseID,
+		BotToken:     botToken,
+		BotUserID:    resp.UserID,
+		NotionToken:  notionToken,
+		RootPages:    rootPages,
+	})
+	if err != nil {
+		return err
+	}
+
+	teams.Forget(resp.EnterpriseID, resp.TeamID)
+	return nil
+}
+
+func NewAPI(botToken string) *slack.Client {
+	return slack.New(
+		botToken,
+		slack.OptionDebug(false),
+		slack.OptionLog(logger.Default.With("component", "slack_api")),
+	)
+}
@@ -0,0 +1,17 @@
+package slack
+
+import (
+	"context"
+
+	"backlink/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// traced runs call, one slack web API method, in a span of its own.
+func traced(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	ctx, span := tracing.Start(ctx, "slack "+method, attribute.String("slack.method", method))
+	err := call(ctx)
+	tracing.End(span, err)
+	return err
+}